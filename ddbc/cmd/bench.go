@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"strings"
 	"sync"
 	"time"
 
@@ -29,11 +30,13 @@ import (
 )
 
 type benchOptions struct {
-	keySize  int
-	n        int
-	qps      float64
-	duration time.Duration
-	nWorkers int
+	n               int
+	qps             float64
+	duration        time.Duration
+	nWorkers        int
+	readFraction    float64
+	distribution    string
+	zipfianConstant float64
 }
 
 var benchOpts benchOptions
@@ -42,7 +45,10 @@ var benchOpts benchOptions
 var benchCmd = &cobra.Command{
 	Use:   "bench",
 	Short: "Benchmark DDB.",
-	Long:  `Runs a configurable benchmark against DDB.`,
+	Long: `Runs a configurable benchmark against DDB, issuing a mix of Get and Put
+requests (see --read_fraction) against keys drawn from a configurable
+distribution (see --distribution), and reports read and write latencies
+separately.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		go common.SetupDebugServer()
 
@@ -59,56 +65,76 @@ var benchCmd = &cobra.Command{
 		}
 		fmt.Println("Done generating keys.")
 
+		// Pre-seed a single value buffer for writes, rather than generating a
+		// fresh random value per Put, so the benchmark measures DDB's write
+		// path instead of genValue's cost.
+		writeValue := genValue()
+
 		endTime := time.Now().Add(benchOpts.duration)
 		wStats := make([]*stats, benchOpts.nWorkers)
 		var wg sync.WaitGroup
 		wg.Add(benchOpts.nWorkers)
 
 		for i := 0; i < benchOpts.nWorkers; i++ {
-			wStats[i] = &stats{hist: hdrhistogram.New(0, 60000000, 3)}
+			wStats[i] = newStats()
 			args := workerArgs{
-				endTime: endTime,
-				keys:    keys,
-				client:  c,
-				qps:     float64(benchOpts.qps) / float64(benchOpts.nWorkers),
-				wg:      &wg,
-				s:       wStats[i],
+				endTime:    endTime,
+				keys:       keys,
+				writeValue: writeValue,
+				client:     c,
+				qps:        float64(benchOpts.qps) / float64(benchOpts.nWorkers),
+				wg:         &wg,
+				s:          wStats[i],
 			}
 			go benchWorker(args)
 		}
 
 		wg.Wait()
 
-		cs := stats{hist: hdrhistogram.New(0, 60000000, 3)}
+		cs := newStats()
 		for _, s := range wStats {
-			cs.hist.Merge(s.hist)
+			cs.readHist.Merge(s.readHist)
+			cs.writeHist.Merge(s.writeHist)
 			cs.errors += s.errors
 		}
 
+		totalOps := cs.readHist.TotalCount() + cs.writeHist.TotalCount()
 		fmt.Printf("Run complete. Average QPS: %.3f, Total Requests:%v, Errors:%v\n",
-			float64(cs.hist.TotalCount())/benchOpts.duration.Seconds(), cs.hist.TotalCount(), cs.errors)
+			float64(totalOps)/benchOpts.duration.Seconds(), totalOps, cs.errors)
 
-		fmt.Printf("p50: %vus, p95: %vus, p99: %vus",
-			cs.hist.ValueAtQuantile(.5), cs.hist.ValueAtQuantile(.95), cs.hist.ValueAtQuantile(.99))
+		fmt.Printf("reads  (%v) - p50: %vus, p95: %vus, p99: %vus\n",
+			cs.readHist.TotalCount(), cs.readHist.ValueAtQuantile(50), cs.readHist.ValueAtQuantile(95), cs.readHist.ValueAtQuantile(99))
+		fmt.Printf("writes (%v) - p50: %vus, p95: %vus, p99: %vus\n",
+			cs.writeHist.TotalCount(), cs.writeHist.ValueAtQuantile(50), cs.writeHist.ValueAtQuantile(95), cs.writeHist.ValueAtQuantile(99))
 	},
 }
 
 type stats struct {
-	hist   *hdrhistogram.Histogram
-	errors int64
+	readHist  *hdrhistogram.Histogram
+	writeHist *hdrhistogram.Histogram
+	errors    int64
+}
+
+func newStats() *stats {
+	return &stats{
+		readHist:  hdrhistogram.New(0, 60000000, 3),
+		writeHist: hdrhistogram.New(0, 60000000, 3),
+	}
 }
 
 type workerArgs struct {
-	endTime time.Time
-	keys    []string
-	client  pb.DdbClient
-	qps     float64
-	wg      *sync.WaitGroup
-	s       *stats
+	endTime    time.Time
+	keys       []string
+	writeValue []byte
+	client     pb.DdbClient
+	qps        float64
+	wg         *sync.WaitGroup
+	s          *stats
 }
 
 func benchWorker(args workerArgs) {
 	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	chooser := newKeyChooserForDistribution(benchOpts.distribution, rnd, len(args.keys), benchOpts.zipfianConstant)
 
 	sleepNanos := rand.Int63n(int64(float64(time.Second.Nanoseconds()) / args.qps))
 	time.Sleep(time.Duration(sleepNanos) * time.Nanosecond)
@@ -121,15 +147,26 @@ func benchWorker(args workerArgs) {
 		}
 		ctx := context.Background()
 
-		req := &pb.GetRequest{Key: args.keys[rnd.Intn(len(args.keys))]}
+		key := args.keys[chooser.next()]
+		isRead := rnd.Float64() < benchOpts.readFraction
+
+		var err error
 		start := time.Now()
-		_, err := args.client.Get(ctx, req)
+		if isRead {
+			_, err = args.client.Get(ctx, &pb.GetRequest{Key: key})
+		} else {
+			_, err = args.client.Set(ctx, &pb.SetRequest{Key: key, Value: args.writeValue})
+		}
 		elapsed := time.Now().Sub(start)
 
 		if err != nil {
 			args.s.errors++
 		}
-		if err := args.s.hist.RecordCorrectedValue(elapsed.Nanoseconds()/1000, intervalNanos/1000); err != nil {
+		hist := args.s.readHist
+		if !isRead {
+			hist = args.s.writeHist
+		}
+		if err := hist.RecordCorrectedValue(elapsed.Nanoseconds()/1000, intervalNanos/1000); err != nil {
 			panic(fmt.Sprintf("error recording %v", err))
 		}
 	}
@@ -137,12 +174,32 @@ func benchWorker(args workerArgs) {
 	args.wg.Done()
 }
 
+// newKeyChooserForDistribution returns the keyChooser backing --distribution.
+// "latest" biases towards the end of keys, treating the whole pre-generated
+// keyspace as already inserted, since bench (unlike runworkload) never grows
+// the keyspace during the run.
+func newKeyChooserForDistribution(distribution string, rnd *rand.Rand, n int, zipfianConstant float64) keyChooser {
+	switch strings.ToLower(distribution) {
+	case "zipfian":
+		return newZipfianChooser(rnd, n, zipfianConstant)
+	case "latest":
+		count := int64(n)
+		return newLatestChooser(rnd, &count, zipfianConstant)
+	default:
+		return newUniformChooser(rnd, n)
+	}
+}
+
 func init() {
 	rootCmd.AddCommand(benchCmd)
 
-	benchCmd.Flags().IntVar(&benchOpts.keySize, "key_size", 10, "Key length")
+	benchCmd.Flags().IntVar(&keySize, "key_size", 10, "Key length")
+	benchCmd.Flags().IntVar(&valueSize, "value_size", 800, "Value length")
 	benchCmd.Flags().IntVar(&benchOpts.n, "n", 1000, "Number of entries")
 	benchCmd.Flags().IntVar(&benchOpts.nWorkers, "workers", 500, "Number of workers")
 	benchCmd.Flags().Float64Var(&benchOpts.qps, "qps", 10, "QPS")
 	benchCmd.Flags().DurationVar(&benchOpts.duration, "duration", 30*time.Second, "Duration of test")
+	benchCmd.Flags().Float64Var(&benchOpts.readFraction, "read_fraction", 1.0, "Fraction of ops that are reads; the remainder are writes")
+	benchCmd.Flags().StringVar(&benchOpts.distribution, "distribution", "uniform", "Key distribution: uniform|zipfian|latest")
+	benchCmd.Flags().Float64Var(&benchOpts.zipfianConstant, "zipfian_constant", 0.99, "Zipfian constant, used by the zipfian and latest distributions")
 }
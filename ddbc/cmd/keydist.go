@@ -0,0 +1,177 @@
+//    Copyright 2018 Google Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cmd
+
+import (
+	"math"
+	"math/rand"
+)
+
+// keyChooser picks an index in [0, n) according to some distribution over an
+// existing key population. Implementations are not expected to be safe for
+// concurrent use; runworkload gives each worker its own instance.
+type keyChooser interface {
+	next() int
+}
+
+// uniformChooser picks indexes with equal probability.
+type uniformChooser struct {
+	rnd *rand.Rand
+	n   int
+}
+
+func newUniformChooser(rnd *rand.Rand, n int) *uniformChooser {
+	return &uniformChooser{rnd: rnd, n: n}
+}
+
+func (c *uniformChooser) next() int {
+	return c.rnd.Intn(c.n)
+}
+
+// zipfianChooser draws indexes in [0, n) from a Zipfian distribution, so a
+// small "head" of keys is chosen disproportionately often. It uses the
+// rejection-inversion algorithm of Hörmann and Derflinger, which samples in
+// O(1) time after an O(1) setup cost (no need to precompute a running sum
+// over all n items, unlike the naive CDF-inversion approach).
+type zipfianChooser struct {
+	rnd *rand.Rand
+	n   int
+
+	exponent float64
+
+	// hIntegralX1 and hIntegralN are the precomputed normalization bounds of
+	// the integral of h(x)=x^-exponent over [1,n], used to map a uniform
+	// draw onto the sampling domain in O(1).
+	hIntegralX1 float64
+	hIntegralN  float64
+	s           float64
+}
+
+// newZipfianChooser returns a chooser over indexes [0, n) with the given
+// Zipfian constant (YCSB and most literature use ~0.99).
+func newZipfianChooser(rnd *rand.Rand, n int, zipfianConstant float64) *zipfianChooser {
+	c := &zipfianChooser{rnd: rnd, n: n, exponent: zipfianConstant}
+	c.hIntegralX1 = c.hIntegral(1.5) - 1
+	c.hIntegralN = c.hIntegral(float64(n) + 0.5)
+	c.s = 2 - c.hIntegralInverse(c.hIntegral(2.5)-c.h(2))
+	return c
+}
+
+func (c *zipfianChooser) next() int {
+	for {
+		u := c.hIntegralN + c.rnd.Float64()*(c.hIntegralX1-c.hIntegralN)
+		x := c.hIntegralInverse(u)
+		k := int(x + 0.5)
+		if k < 1 {
+			k = 1
+		} else if k > c.n {
+			k = c.n
+		}
+		if float64(k)-x <= c.s || u >= c.hIntegral(float64(k)+0.5)-c.h(float64(k)) {
+			return k - 1
+		}
+	}
+}
+
+// h is the Zipf density kernel x^-exponent.
+func (c *zipfianChooser) h(x float64) float64 {
+	return math.Exp(-c.exponent * math.Log(x))
+}
+
+// hIntegral is the indefinite integral of h, used to invert a uniform draw
+// into a sample without summing over every item.
+func (c *zipfianChooser) hIntegral(x float64) float64 {
+	logX := math.Log(x)
+	return helper2((1-c.exponent)*logX) * logX
+}
+
+// hIntegralInverse inverts hIntegral.
+func (c *zipfianChooser) hIntegralInverse(x float64) float64 {
+	t := x * (1 - c.exponent)
+	if t < -1 {
+		t = -1
+	}
+	return math.Exp(helper1(t) * x)
+}
+
+// helper1 and helper2 are numerically stable forms of log1p(x)/x and
+// expm1(x)/x respectively, needed because hIntegral/hIntegralInverse
+// evaluate them at x close to 0.
+func helper1(x float64) float64 {
+	if math.Abs(x) > 1e-8 {
+		return math.Log1p(x) / x
+	}
+	return 1 - x*(1.0/2-x*(1.0/3-x*(1.0/4)))
+}
+
+func helper2(x float64) float64 {
+	if math.Abs(x) > 1e-8 {
+		return math.Expm1(x) / x
+	}
+	return 1 + x*0.5*(1+x/3*(1+x/4))
+}
+
+// latestChooser biases towards recently inserted keys: it draws a Zipfian
+// offset back from the current insertion count, so offset 0 (the most
+// recently inserted key) is the most likely outcome.
+type latestChooser struct {
+	zipf    *zipfianChooser
+	counter *int64
+}
+
+// newLatestChooser returns a chooser over the first *counter keys, where
+// counter is expected to be advanced by the caller as new keys are inserted.
+func newLatestChooser(rnd *rand.Rand, counter *int64, zipfianConstant float64) *latestChooser {
+	n := int(*counter)
+	if n < 1 {
+		n = 1
+	}
+	return &latestChooser{zipf: newZipfianChooser(rnd, n, zipfianConstant), counter: counter}
+}
+
+func (c *latestChooser) next() int {
+	n := int(*c.counter)
+	offset := c.zipf.next()
+	if offset >= n {
+		offset = n - 1
+	}
+	return n - 1 - offset
+}
+
+// hotspotChooser sends hotFraction of traffic to hotDataFraction of the
+// keyspace, and the remainder uniformly across the rest. Unlike Zipfian,
+// every hot key is equally likely, which makes it easy to reason about a
+// fixed-size "hot set" overwhelming a cache or block.
+type hotspotChooser struct {
+	rnd             *rand.Rand
+	n               int
+	hotDataFraction float64
+	hotFraction     float64
+}
+
+func newHotspotChooser(rnd *rand.Rand, n int, hotDataFraction, hotFraction float64) *hotspotChooser {
+	return &hotspotChooser{rnd: rnd, n: n, hotDataFraction: hotDataFraction, hotFraction: hotFraction}
+}
+
+func (c *hotspotChooser) next() int {
+	hotN := int(float64(c.n) * c.hotDataFraction)
+	if hotN < 1 {
+		hotN = 1
+	}
+	if c.rnd.Float64() < c.hotFraction {
+		return c.rnd.Intn(hotN)
+	}
+	return hotN + c.rnd.Intn(c.n-hotN)
+}
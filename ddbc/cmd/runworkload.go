@@ -0,0 +1,374 @@
+//    Copyright 2018 Google Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codahale/hdrhistogram"
+	"github.com/danchia/ddb/ddbc/common"
+	pb "github.com/danchia/ddb/proto"
+	"github.com/spf13/cobra"
+)
+
+// workloadMix is the fraction of ops that should be reads vs.
+// read-modify-writes, with the remainder spent on plain updates. It mirrors
+// the YCSB core workloads closely enough for regression testing, without
+// pulling in scans or inserts.
+type workloadMix struct {
+	readFrac float64
+	rmwFrac  float64
+}
+
+var workloadPresets = map[string]workloadMix{
+	"A": {readFrac: 0.5, rmwFrac: 0},
+	"B": {readFrac: 0.95, rmwFrac: 0},
+	"C": {readFrac: 1.0, rmwFrac: 0},
+	"F": {readFrac: 0.5, rmwFrac: 0.5},
+}
+
+// parseWorkloadMix accepts either a preset name (A/B/C/F) or a custom spec of
+// the form "read=0.5,rmw=0.5" (unspecified fractions default to 0, and the
+// remainder is spent on updates).
+func parseWorkloadMix(spec string) (workloadMix, error) {
+	if mix, ok := workloadPresets[strings.ToUpper(spec)]; ok {
+		return mix, nil
+	}
+
+	var mix workloadMix
+	for _, part := range strings.Split(spec, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return mix, fmt.Errorf("invalid workload spec term %q, want key=value", part)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil {
+			return mix, fmt.Errorf("invalid workload spec term %q: %v", part, err)
+		}
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "read":
+			mix.readFrac = v
+		case "rmw":
+			mix.rmwFrac = v
+		default:
+			return mix, fmt.Errorf("unknown workload spec key %q", kv[0])
+		}
+	}
+	if mix.readFrac+mix.rmwFrac > 1 {
+		return mix, fmt.Errorf("workload spec %q: read+rmw fractions exceed 1", spec)
+	}
+	return mix, nil
+}
+
+type runworkloadOptions struct {
+	workload        string
+	keyDist         string
+	zipfianConstant float64
+	hotDataFraction float64
+	hotOpFraction   float64
+	recordCount     int
+	requestCount    int
+	warmup          time.Duration
+	targetQps       float64
+	workers         int
+	reportInterval  time.Duration
+	output          string
+	format          string
+}
+
+var runworkloadOpts runworkloadOptions
+
+var runworkloadCmd = &cobra.Command{
+	Use:   "runworkload",
+	Short: "Runs a mixed YCSB-style workload against DDB.",
+	Long: `Runs an open-loop, mixed read/update workload against DDB, modeled on
+the standard YCSB core workloads (A/B/C/F), reporting latency percentiles
+and throughput.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runWorkload(runworkloadOpts); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func runWorkload(opts runworkloadOptions) error {
+	mix, err := parseWorkloadMix(opts.workload)
+	if err != nil {
+		return err
+	}
+
+	c, err := common.GetDDB(serverAddr)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Loading keyspace.")
+	keys := make([]string, opts.recordCount)
+	keyGen := newKeyGenerator()
+	for i := range keys {
+		keys[i] = keyGen.next()
+	}
+	for i, k := range keys {
+		if _, err := c.Set(context.Background(), &pb.SetRequest{Key: k, Value: genValue()}); err != nil {
+			return fmt.Errorf("loading key %v: %v", i, err)
+		}
+	}
+	fmt.Println("Done loading keyspace.")
+
+	// insertCount backs the "latest" key distribution. This workload doesn't
+	// issue Insert ops during the run (matching YCSB core workloads A/B/C/F),
+	// so it stays pinned at recordCount; "latest" then just means "most
+	// recently loaded", biased via the same Zipfian offset.
+	insertCount := int64(opts.recordCount)
+
+	if opts.warmup > 0 {
+		fmt.Printf("Warming up for %v.\n", opts.warmup)
+		runOps(opts, mix, keys, &insertCount, time.Now().Add(opts.warmup), 0, nil, c)
+	}
+
+	cs := &workloadStats{hist: hdrhistogram.New(0, 60000000, 3)}
+	stop := make(chan struct{})
+	if opts.reportInterval > 0 {
+		go reportProgress(cs, opts.reportInterval, stop)
+	}
+
+	start := time.Now()
+	runOps(opts, mix, keys, &insertCount, time.Time{}, opts.requestCount, cs, c)
+	elapsed := time.Now().Sub(start)
+	close(stop)
+
+	printSummary(cs, elapsed)
+	if opts.output != "" {
+		return writeResults(opts, cs, elapsed)
+	}
+	return nil
+}
+
+type workloadStats struct {
+	mu     sync.Mutex
+	hist   *hdrhistogram.Histogram
+	errors int64
+	ops    int64
+}
+
+func (s *workloadStats) record(micros, correctionMicros int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.errors++
+	}
+	s.ops++
+	if err := s.hist.RecordCorrectedValue(micros, correctionMicros); err != nil {
+		panic(fmt.Sprintf("error recording latency: %v", err))
+	}
+}
+
+// runOps drives requestCount ops (or until deadline, if requestCount is 0)
+// across opts.workers goroutines, optionally open-loop rate limited to
+// opts.targetQps. Pass a nil stats to run unmeasured (i.e. for warmup).
+func runOps(opts runworkloadOptions, mix workloadMix, keys []string, insertCount *int64, deadline time.Time, requestCount int, cs *workloadStats, c pb.DdbClient) {
+	var remaining int64
+	if requestCount > 0 {
+		remaining = int64(requestCount)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(opts.workers)
+	for w := 0; w < opts.workers; w++ {
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			chooser := newKeyChooser(opts, rnd, keys, insertCount)
+
+			var intervalNanos int64
+			var ticker *time.Ticker
+			if opts.targetQps > 0 {
+				perWorkerQps := opts.targetQps / float64(opts.workers)
+				intervalNanos = int64(float64(time.Second.Nanoseconds()) / perWorkerQps)
+				ticker = time.NewTicker(time.Duration(intervalNanos) * time.Nanosecond)
+				defer ticker.Stop()
+			}
+
+			for {
+				if requestCount > 0 && atomic.AddInt64(&remaining, -1) < 0 {
+					return
+				}
+				if !deadline.IsZero() && time.Now().After(deadline) {
+					return
+				}
+				if ticker != nil {
+					<-ticker.C
+				}
+
+				key := keys[chooser.next()%len(keys)]
+				opRnd := rnd.Float64()
+				start := time.Now()
+				var err error
+				switch {
+				case opRnd < mix.readFrac:
+					_, err = c.Get(context.Background(), &pb.GetRequest{Key: key})
+				case opRnd < mix.readFrac+mix.rmwFrac:
+					if _, gerr := c.Get(context.Background(), &pb.GetRequest{Key: key}); gerr != nil {
+						err = gerr
+						break
+					}
+					_, err = c.Set(context.Background(), &pb.SetRequest{Key: key, Value: genValue()})
+				default:
+					_, err = c.Set(context.Background(), &pb.SetRequest{Key: key, Value: genValue()})
+				}
+				elapsed := time.Now().Sub(start)
+
+				if cs != nil {
+					cs.record(elapsed.Nanoseconds()/1000, intervalNanos/1000, err)
+				}
+			}
+		}(int64(w) + time.Now().UnixNano())
+	}
+	wg.Wait()
+}
+
+func newKeyChooser(opts runworkloadOptions, rnd *rand.Rand, keys []string, insertCount *int64) keyChooser {
+	switch strings.ToLower(opts.keyDist) {
+	case "zipfian":
+		return newZipfianChooser(rnd, len(keys), opts.zipfianConstant)
+	case "latest":
+		return newLatestChooser(rnd, insertCount, opts.zipfianConstant)
+	case "hotspot":
+		return newHotspotChooser(rnd, len(keys), opts.hotDataFraction, opts.hotOpFraction)
+	default:
+		return newUniformChooser(rnd, len(keys))
+	}
+}
+
+func reportProgress(cs *workloadStats, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lastOps int64
+	lastT := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case t := <-ticker.C:
+			cs.mu.Lock()
+			ops := cs.ops
+			p50, p95, p99 := cs.hist.ValueAtQuantile(50), cs.hist.ValueAtQuantile(95), cs.hist.ValueAtQuantile(99)
+			cs.mu.Unlock()
+
+			qps := float64(ops-lastOps) / t.Sub(lastT).Seconds()
+			fmt.Printf("[%v] qps=%.1f p50=%vus p95=%vus p99=%vus\n", interval, qps, p50, p95, p99)
+			lastOps = ops
+			lastT = t
+		}
+	}
+}
+
+func printSummary(cs *workloadStats, elapsed time.Duration) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	fmt.Printf("Run complete in %v. Ops: %v, Errors: %v, QPS: %.1f\n",
+		elapsed, cs.hist.TotalCount(), cs.errors, float64(cs.hist.TotalCount())/elapsed.Seconds())
+	fmt.Printf("p50: %vus, p95: %vus, p99: %vus, p999: %vus\n",
+		cs.hist.ValueAtQuantile(50), cs.hist.ValueAtQuantile(95), cs.hist.ValueAtQuantile(99), cs.hist.ValueAtQuantile(99.9))
+}
+
+// writeResults records a one-line summary of the run as CSV or JSON, so
+// operators can diff successive runs instead of scraping stdout.
+func writeResults(opts runworkloadOptions, cs *workloadStats, elapsed time.Duration) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	type result struct {
+		Workload string  `json:"workload"`
+		KeyDist  string  `json:"key_dist"`
+		Ops      int64   `json:"ops"`
+		Errors   int64   `json:"errors"`
+		Qps      float64 `json:"qps"`
+		P50Us    int64   `json:"p50_us"`
+		P95Us    int64   `json:"p95_us"`
+		P99Us    int64   `json:"p99_us"`
+		P999Us   int64   `json:"p999_us"`
+	}
+	r := result{
+		Workload: opts.workload,
+		KeyDist:  opts.keyDist,
+		Ops:      cs.hist.TotalCount(),
+		Errors:   cs.errors,
+		Qps:      float64(cs.hist.TotalCount()) / elapsed.Seconds(),
+		P50Us:    cs.hist.ValueAtQuantile(50),
+		P95Us:    cs.hist.ValueAtQuantile(95),
+		P99Us:    cs.hist.ValueAtQuantile(99),
+		P999Us:   cs.hist.ValueAtQuantile(99.9),
+	}
+
+	f, err := os.Create(opts.output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch opts.format {
+	case "json":
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	default:
+		w := csv.NewWriter(f)
+		defer w.Flush()
+		header := []string{"workload", "key_dist", "ops", "errors", "qps", "p50_us", "p95_us", "p99_us", "p999_us"}
+		row := []string{
+			r.Workload, r.KeyDist,
+			strconv.FormatInt(r.Ops, 10), strconv.FormatInt(r.Errors, 10),
+			strconv.FormatFloat(r.Qps, 'f', 1, 64),
+			strconv.FormatInt(r.P50Us, 10), strconv.FormatInt(r.P95Us, 10),
+			strconv.FormatInt(r.P99Us, 10), strconv.FormatInt(r.P999Us, 10),
+		}
+		if err := w.Write(header); err != nil {
+			return err
+		}
+		return w.Write(row)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(runworkloadCmd)
+
+	runworkloadCmd.Flags().StringVar(&runworkloadOpts.workload, "workload", "B", "Workload mix: A|B|C|F, or a custom spec like \"read=0.5,rmw=0.5\"")
+	runworkloadCmd.Flags().StringVar(&runworkloadOpts.keyDist, "key_dist", "uniform", "Key distribution: uniform|zipfian|latest|hotspot")
+	runworkloadCmd.Flags().Float64Var(&runworkloadOpts.zipfianConstant, "zipfian_constant", 0.99, "Zipfian constant, used by the zipfian and latest key distributions")
+	runworkloadCmd.Flags().Float64Var(&runworkloadOpts.hotDataFraction, "hotspot_data_fraction", 0.2, "Fraction of the keyspace considered hot, for the hotspot key distribution")
+	runworkloadCmd.Flags().Float64Var(&runworkloadOpts.hotOpFraction, "hotspot_op_fraction", 0.8, "Fraction of ops directed at the hot keyspace, for the hotspot key distribution")
+	runworkloadCmd.Flags().IntVar(&runworkloadOpts.recordCount, "record_count", 1000, "Number of keys to pre-load before running the workload")
+	runworkloadCmd.Flags().IntVar(&runworkloadOpts.requestCount, "request_count", 10000, "Number of ops to run during the measured phase")
+	runworkloadCmd.Flags().DurationVar(&runworkloadOpts.warmup, "warmup", 0, "Duration to run unmeasured before recording stats")
+	runworkloadCmd.Flags().Float64Var(&runworkloadOpts.targetQps, "target_qps", 0, "Open-loop target QPS across all workers. 0 means closed-loop (no rate limit)")
+	runworkloadCmd.Flags().IntVar(&keySize, "key_size", 10, "Key length")
+	runworkloadCmd.Flags().IntVar(&valueSize, "value_size", 800, "Value length")
+	runworkloadCmd.Flags().IntVar(&runworkloadOpts.workers, "workers", 20, "Number of concurrent workers")
+	runworkloadCmd.Flags().DurationVar(&runworkloadOpts.reportInterval, "report_interval", 10*time.Second, "Interval at which to print throughput/latency. 0 disables periodic reporting")
+	runworkloadCmd.Flags().StringVar(&runworkloadOpts.output, "output", "", "File to record final results to, as CSV or JSON (see --format)")
+	runworkloadCmd.Flags().StringVar(&runworkloadOpts.format, "format", "csv", "Format for --output: csv|json")
+}
@@ -52,15 +52,17 @@ func main() {
 
 	glog.Infof("Listening on ports %d (main), %d (debug)...\n", *port, *debugPort)
 
-	go startDebugServer()
+	go startDebugServer(ds)
 
 	if err := gs.Serve(lis); err != nil {
 		glog.Fatalf("Failed to serve: %v", err)
 	}
 }
 
-func startDebugServer() {
+func startDebugServer(ds *server.Server) {
 	zpages.AddDefaultHTTPHandlers()
+	http.HandleFunc("/debug/requests", server.Traces)
+	http.HandleFunc("/debug/ratelimit", ds.RateLimits)
 	if err := http.ListenAndServe(fmt.Sprintf(":%d", *debugPort), nil); err != nil {
 		glog.Fatalf("Failed to serve debug: %v", err)
 	}
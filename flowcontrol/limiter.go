@@ -0,0 +1,62 @@
+package flowcontrol
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Limiter rejects callers once a Monitor's EMA throughput has sustained
+// above a configured ceiling, rather than blocking them like
+// ratelimit.Limiter does for background jobs. This gives a foreground write
+// path immediate back-pressure instead of an unbounded queue.
+type Limiter struct {
+	monitor    *Monitor
+	ceilingBps float64
+	sustainFor time.Duration
+
+	mu         sync.Mutex
+	exceededAt time.Time
+}
+
+// NewLimiter returns a Limiter that admits calls so long as monitor's EMA
+// throughput stays at or below ceilingBps. Once the EMA has been above
+// ceilingBps continuously for sustainFor, Admit starts rejecting calls with
+// a codes.Unavailable status, until the EMA falls back to or under the
+// ceiling. ceilingBps <= 0 means unlimited; Admit never rejects.
+func NewLimiter(monitor *Monitor, ceilingBps float64, sustainFor time.Duration) *Limiter {
+	return &Limiter{monitor: monitor, ceilingBps: ceilingBps, sustainFor: sustainFor}
+}
+
+// Admit inspects the underlying Monitor's current EMA throughput and
+// returns a codes.Unavailable error if it has sustained above the ceiling
+// for at least sustainFor. The overage is timed from the first Admit call
+// that sees the EMA above the ceiling. Callers are expected to record their own bytes
+// against the Monitor (via Update) independently of Admit.
+func (l *Limiter) Admit() error {
+	if l.ceilingBps <= 0 {
+		return nil
+	}
+
+	ema := l.monitor.Status().BytesPerSecEMA
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if ema <= l.ceilingBps {
+		l.exceededAt = time.Time{}
+		return nil
+	}
+
+	now := time.Now()
+	if l.exceededAt.IsZero() {
+		l.exceededAt = now
+		return nil
+	}
+	if now.Sub(l.exceededAt) < l.sustainFor {
+		return nil
+	}
+	return status.Errorf(codes.Unavailable, "write throughput %.0f bytes/sec has exceeded %.0f bytes/sec for over %v", ema, l.ceilingBps, l.sustainFor)
+}
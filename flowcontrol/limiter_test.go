@@ -0,0 +1,59 @@
+package flowcontrol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterUnlimitedNeverRejects(t *testing.T) {
+	m := NewMonitor(time.Second)
+	l := NewLimiter(m, 0, time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		m.Update(1 << 20)
+		if err := l.Admit(); err != nil {
+			t.Fatalf("Admit() = %v, want nil for an unlimited Limiter", err)
+		}
+	}
+}
+
+func TestLimiterRejectsAfterSustainedOverage(t *testing.T) {
+	m := NewMonitor(time.Millisecond)
+	l := NewLimiter(m, 100, 20*time.Millisecond)
+
+	// Drive the EMA well over the ceiling immediately.
+	m.Update(1 << 20)
+	if err := l.Admit(); err != nil {
+		t.Fatalf("Admit() = %v, want nil before the overage has sustained", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	m.Update(1 << 20)
+	if err := l.Admit(); err == nil {
+		t.Fatalf("Admit() = nil, want an Unavailable error after sustained overage")
+	}
+}
+
+func TestLimiterReadmitsOnceBelowCeiling(t *testing.T) {
+	m := NewMonitor(time.Millisecond)
+	l := NewLimiter(m, 100, 5*time.Millisecond)
+
+	m.Update(1 << 20)
+	if err := l.Admit(); err != nil {
+		t.Fatalf("Admit() = %v, want nil before the overage has sustained", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	m.Update(1 << 20)
+	if err := l.Admit(); err == nil {
+		t.Fatalf("Admit() = nil, want an Unavailable error after sustained overage")
+	}
+
+	// Let the EMA decay back under the ceiling.
+	for i := 0; i < 20; i++ {
+		time.Sleep(2 * time.Millisecond)
+		m.Update(0)
+	}
+	if err := l.Admit(); err != nil {
+		t.Errorf("Admit() = %v, want nil once throughput has fallen back under the ceiling", err)
+	}
+}
@@ -0,0 +1,106 @@
+// Package flowcontrol tracks observed transfer rate on a foreground write
+// path and admits or rejects callers once that rate sustains above a
+// configured ceiling. It serves a different purpose to ratelimit: that
+// package smooths out background jobs by blocking them until bandwidth is
+// available, whereas flowcontrol gives immediate back-pressure to
+// foreground callers (e.g. a runaway loaddata worker pool) by rejecting
+// them outright once they've been over budget for too long.
+package flowcontrol
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Status is a snapshot of a Monitor's observed throughput.
+type Status struct {
+	// BytesTotal is the cumulative number of bytes ever recorded.
+	BytesTotal int64
+	// BytesPerSec is the instantaneous rate implied by the most recent
+	// Update call alone.
+	BytesPerSec float64
+	// BytesPerSecEMA is an exponential moving average of BytesPerSec, which
+	// smooths out bursts.
+	BytesPerSecEMA float64
+	// Duration is how long this Monitor has been observing traffic.
+	Duration time.Duration
+	// Active is true once at least one Update call has been recorded.
+	Active bool
+}
+
+// Monitor tracks the transfer rate of a byte stream using an exponential
+// moving average with a configurable half-life. Safe for concurrent use.
+type Monitor struct {
+	halfLife time.Duration
+
+	mu        sync.Mutex
+	start     time.Time
+	last      time.Time
+	total     int64
+	sampleBps float64
+	emaBps    float64
+	active    bool
+}
+
+// NewMonitor returns a Monitor whose EMA decays towards new samples with the
+// given half-life: halfLife after a quiet period, a persisting burst will
+// have pulled the EMA halfway from its old value to the new sample rate.
+func NewMonitor(halfLife time.Duration) *Monitor {
+	return &Monitor{halfLife: halfLife}
+}
+
+// Update records n bytes transferred at the current time.
+func (m *Monitor) Update(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	first := !m.active
+	if first {
+		m.start = now
+		m.last = now
+		m.active = true
+	}
+
+	elapsed := now.Sub(m.last).Seconds()
+	m.last = now
+	m.total += int64(n)
+
+	if elapsed > 0 {
+		m.sampleBps = float64(n) / elapsed
+	} else {
+		m.sampleBps = float64(n)
+	}
+
+	// The first sample seeds the EMA; there is no earlier rate to decay from.
+	if first {
+		m.emaBps = m.sampleBps
+		return
+	}
+
+	// Decay by how much time actually elapsed, so a burst of Updates in
+	// quick succession doesn't whipsaw the EMA more than the same bytes
+	// spread evenly would.
+	decay := math.Exp(-elapsed * math.Ln2 / m.halfLife.Seconds())
+	m.emaBps = decay*m.emaBps + (1-decay)*m.sampleBps
+}
+
+// Status returns a snapshot of the current throughput.
+func (m *Monitor) Status() Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var d time.Duration
+	if m.active {
+		d = time.Since(m.start)
+	}
+
+	return Status{
+		BytesTotal:     m.total,
+		BytesPerSec:    m.sampleBps,
+		BytesPerSecEMA: m.emaBps,
+		Duration:       d,
+		Active:         m.active,
+	}
+}
@@ -0,0 +1,45 @@
+package flowcontrol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMonitorInactiveBeforeFirstUpdate(t *testing.T) {
+	m := NewMonitor(time.Second)
+	s := m.Status()
+	if s.Active {
+		t.Errorf("Status().Active = true before any Update, want false")
+	}
+	if s.BytesTotal != 0 {
+		t.Errorf("Status().BytesTotal = %v, want 0", s.BytesTotal)
+	}
+}
+
+func TestMonitorAccumulatesTotal(t *testing.T) {
+	m := NewMonitor(time.Second)
+	m.Update(100)
+	m.Update(50)
+
+	s := m.Status()
+	if !s.Active {
+		t.Errorf("Status().Active = false after Update, want true")
+	}
+	if s.BytesTotal != 150 {
+		t.Errorf("Status().BytesTotal = %v, want 150", s.BytesTotal)
+	}
+}
+
+func TestMonitorEMATracksSustainedRate(t *testing.T) {
+	m := NewMonitor(20 * time.Millisecond)
+
+	for i := 0; i < 50; i++ {
+		m.Update(1000)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	s := m.Status()
+	if s.BytesPerSecEMA < 50 {
+		t.Errorf("Status().BytesPerSecEMA = %v after sustained traffic, want it to have caught up", s.BytesPerSecEMA)
+	}
+}
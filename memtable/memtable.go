@@ -4,6 +4,7 @@ import (
 	"math"
 	"math/bits"
 	"math/rand"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"unsafe"
@@ -21,11 +22,13 @@ type Memtable struct {
 	head *node
 	rnd  *rand.Rand
 
-	size int64
-	mu   sync.Mutex
+	size     int64
+	seqUpper int64
+	mu       sync.Mutex
 }
 
 type node struct {
+	sequence  int64
 	key       string
 	timestamp int64
 	value     []byte
@@ -40,21 +43,27 @@ func (n *node) atomicLoadNext(l int) *node {
 	return (*node)(atomic.LoadPointer(&n.next[l]))
 }
 
-func New() *Memtable {
+// New returns an empty Memtable. seqUpper is the sequence number up to
+// (and including) which this memtable's contents are already durable, e.g.
+// the upper bound recovered from the descriptor on startup, or the previous
+// memtable's SequenceUpper when rotating in a new one.
+func New(seqUpper int64) *Memtable {
 	h := &node{
 		key:   "",
 		value: nil,
 		next:  make([]unsafe.Pointer, maxLevel),
 	}
 	return &Memtable{
-		head: h,
-		rnd:  rand.New(rand.NewSource(134787)),
+		head:     h,
+		rnd:      rand.New(rand.NewSource(134787)),
+		seqUpper: seqUpper,
 	}
 }
 
-// Insert inserts (key, timestamp, value) into the memtable.
+// Insert inserts (key, timestamp, value) into the memtable, recording
+// sequence as the log sequence number this mutation was assigned.
 // Requires that (key, timestamp) does not already exist.
-func (m *Memtable) Insert(key string, timestamp int64, value []byte) {
+func (m *Memtable) Insert(sequence int64, key string, timestamp int64, value []byte) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -71,6 +80,7 @@ func (m *Memtable) Insert(key string, timestamp int64, value []byte) {
 
 	level := m.pickLevel()
 	newNode := &node{
+		sequence:  sequence,
 		key:       key,
 		timestamp: timestamp,
 		value:     value,
@@ -82,6 +92,10 @@ func (m *Memtable) Insert(key string, timestamp int64, value []byte) {
 		newNode.atomicStoreNext(i, prev[i].atomicLoadNext(i))
 		prev[i].atomicStoreNext(i, newNode)
 	}
+
+	if sequence > m.seqUpper {
+		m.seqUpper = sequence
+	}
 }
 
 // SizeBytes returns the approximate memory used by this memtable.
@@ -91,6 +105,14 @@ func (m *Memtable) SizeBytes() int64 {
 	return m.size
 }
 
+// SequenceUpper returns the highest sequence number inserted into this
+// memtable, or the seqUpper passed to New if nothing has been inserted yet.
+func (m *Memtable) SequenceUpper() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.seqUpper
+}
+
 // findGreaterOrEqual retuns the first node that is greater than or equal to (key, timestamp).
 // according to (key, timestamp) ordering.
 // If prev is not nil, filled with the last node visited per level.
@@ -114,8 +136,9 @@ func (m *Memtable) findGreaterOrEqual(key string, timestamp int64, prev []*node)
 	return nextAtLevel
 }
 
-// Find returns value of key at largest timestamp, or nil if not found.
-func (m *Memtable) Find(key string) []byte {
+// Find returns the value of key at its largest timestamp, and whether key
+// was found at all.
+func (m *Memtable) Find(key string) ([]byte, bool) {
 	if key == "" {
 		glog.Fatal("Invalid empty key.")
 	}
@@ -123,16 +146,38 @@ func (m *Memtable) Find(key string) []byte {
 	n := m.findGreaterOrEqual(key, math.MaxInt64, nil)
 
 	if n != nil && n.key == key {
-		return n.value
+		return n.value, true
+	}
+	return nil, false
+}
+
+// FindAsOf returns the value of key as of (at or before) sequence number
+// seq, and whether such an entry exists. Versions of key are stored
+// timestamp-descending, but sequence and timestamp can disagree under
+// concurrent writers, so this walks every version looking for the first
+// with sequence <= seq, rather than assuming the highest-timestamp version
+// is also the first with a low-enough sequence.
+func (m *Memtable) FindAsOf(key string, seq int64) ([]byte, bool) {
+	if key == "" {
+		glog.Fatal("Invalid empty key.")
+	}
+
+	n := m.findGreaterOrEqual(key, math.MaxInt64, nil)
+	for n != nil && n.key == key {
+		if n.sequence <= seq {
+			return n.value, true
+		}
+		n = n.atomicLoadNext(0)
 	}
-	return nil
+	return nil, false
 }
 
 // Iterator iterates entries in the memtable in ascending key order.
 // Close() must be called after use.
 type Iterator struct {
-	m *Memtable
-	n *node
+	m   *Memtable
+	n   *node
+	end string
 }
 
 // NewIterator creates an iterator for this memtable.
@@ -143,12 +188,59 @@ func (m *Memtable) NewIterator() *Iterator {
 	}
 }
 
+// NewRangeIterator creates an iterator positioned at the first row with key
+// in [start, end), in ascending key order. An empty end means unbounded
+// above. Close() must be called after use.
+func (m *Memtable) NewRangeIterator(start, end string) *Iterator {
+	i := &Iterator{m: m, end: end}
+	i.n = m.findGreaterOrEqual(start, math.MaxInt64, nil)
+	i.clampEnd()
+	return i
+}
+
+// clampEnd invalidates the iterator if it has advanced to or past end.
+func (i *Iterator) clampEnd() {
+	if i.end != "" && i.n != nil && i.n.key >= i.end {
+		i.n = nil
+	}
+}
+
+// SeekGE positions the iterator at the first row with key >= the given key.
+// Returns whether such a row exists.
+func (i *Iterator) SeekGE(key string) bool {
+	i.n = i.m.findGreaterOrEqual(key, math.MaxInt64, nil)
+	return i.n != nil
+}
+
+// SeekPrefix positions the iterator at the first row whose key has the given
+// prefix. Returns whether such a row exists. Does not bound subsequent Next
+// calls to the prefix; callers should check Key() themselves.
+func (i *Iterator) SeekPrefix(prefix string) bool {
+	if !i.SeekGE(prefix) {
+		return false
+	}
+	if !strings.HasPrefix(i.n.key, prefix) {
+		i.n = nil
+		return false
+	}
+	return true
+}
+
 // Next advances the iterator. Returns true if there is a next value.
 func (i *Iterator) Next() bool {
+	if i.n == nil {
+		return false
+	}
 	i.n = i.n.atomicLoadNext(0)
+	i.clampEnd()
 	return i.n != nil
 }
 
+// Valid returns whether the iterator is positioned at a row.
+func (i *Iterator) Valid() bool {
+	return i.n != nil && i.n != i.m.head
+}
+
 // Key returns the current key.
 func (i *Iterator) Key() string {
 	return i.n.key
@@ -164,8 +256,12 @@ func (i *Iterator) Value() []byte {
 	return i.n.value
 }
 
+// Err returns the first error encountered during iteration. Always nil;
+// memtable iteration cannot fail.
+func (i *Iterator) Err() error { return nil }
+
 // Close closes the iterator.
-func (i *Iterator) Close() {}
+func (i *Iterator) Close() error { return nil }
 
 // Level assigned to this node, zero indexed.
 func (m *Memtable) pickLevel() int {
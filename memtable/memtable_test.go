@@ -112,6 +112,57 @@ func TestIterator(t *testing.T) {
 
 }
 
+func TestRangeIterator(t *testing.T) {
+	tests := []struct {
+		name       string
+		insert     []kv
+		start, end string
+		want       []kv
+	}{
+		{"0 entries", []kv{}, "", "", []kv{}},
+		{"unbounded",
+			[]kv{kv{"a", 1, []byte("1")}, kv{"b", 1, []byte("2")}, kv{"c", 1, []byte("3")}},
+			"", "",
+			[]kv{kv{"a", 1, []byte("1")}, kv{"b", 1, []byte("2")}, kv{"c", 1, []byte("3")}}},
+		{"start bound excludes before",
+			[]kv{kv{"a", 1, []byte("1")}, kv{"b", 1, []byte("2")}, kv{"c", 1, []byte("3")}},
+			"b", "",
+			[]kv{kv{"b", 1, []byte("2")}, kv{"c", 1, []byte("3")}}},
+		{"end bound excludes at and after",
+			[]kv{kv{"a", 1, []byte("1")}, kv{"b", 1, []byte("2")}, kv{"c", 1, []byte("3")}},
+			"", "c",
+			[]kv{kv{"a", 1, []byte("1")}, kv{"b", 1, []byte("2")}}},
+		{"start and end bound",
+			[]kv{kv{"a", 1, []byte("1")}, kv{"b", 1, []byte("2")}, kv{"c", 1, []byte("3")}, kv{"d", 1, []byte("4")}},
+			"b", "d",
+			[]kv{kv{"b", 1, []byte("2")}, kv{"c", 1, []byte("3")}}},
+		{"no keys in range",
+			[]kv{kv{"a", 1, []byte("1")}, kv{"z", 1, []byte("2")}},
+			"b", "c",
+			[]kv{}},
+	}
+	for _, tt := range tests {
+		m := New(0)
+		t.Run(tt.name, func(t *testing.T) {
+			for i, kv := range tt.insert {
+				m.Insert(int64(i+1), kv.Key, kv.Timestamp, kv.Value)
+			}
+			got := make([]kv, 0)
+
+			i := m.NewRangeIterator(tt.start, tt.end)
+			for i.Valid() {
+				got = append(got, kv{i.Key(), i.Timestamp(), i.Value()})
+				i.Next()
+			}
+			i.Close()
+
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Errorf("RangeIterator differs: (-got +want)\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestRandomData(t *testing.T) {
 	type tv struct {
 		timestamp int64
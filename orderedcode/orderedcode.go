@@ -0,0 +1,214 @@
+// Package orderedcode extends github.com/google/orderedcode with the extra
+// types ddb needs ([]byte, fixed-width integers, and time.Time) without
+// modifying the vendored upstream package itself, so a vendor resync can't
+// silently drop them and upstream code isn't misattributed as ddb's own.
+// Every type upstream already supports (string, TrailingString, Infinity,
+// float64, int64, uint64, StringOrInfinity, and Decr-wrapped versions of any
+// of those) passes straight through to it.
+package orderedcode
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	upstream "github.com/google/orderedcode"
+)
+
+// Infinity is a value greater than all other values, including other
+// infinities.
+var Infinity = upstream.Infinity
+
+// TrailingString is like a string, except that it is encoded as itself,
+// with no escaping or terminator. It is only valid as the last value
+// passed to Append or Parse.
+type TrailingString = upstream.TrailingString
+
+// StringOrInfinity decodes a value that was encoded either as a string or
+// as Infinity. Exactly one of String and Infinity is meaningful: if the
+// encoded value was Infinity, Infinity is true and String is "".
+type StringOrInfinity = upstream.StringOrInfinity
+
+var errCorrupt = errors.New("orderedcode: corrupt input")
+
+// decr wraps a value (for Append) or a pointer (for Parse) so that it is
+// encoded or decoded in decreasing order. It's a distinct type from
+// upstream's own Decr wrapper because the value it wraps may need
+// converting to an upstream-supported type before upstream ever sees it.
+type decr struct {
+	x interface{}
+}
+
+// Decr returns a wrapper around x such that, when passed to Append or
+// Parse, x is encoded or decoded in decreasing order instead of the
+// default increasing order.
+func Decr(x interface{}) interface{} {
+	return decr{x}
+}
+
+// Append appends the encoding of vals to dst and returns the extended
+// buffer. In addition to every type upstream supports, vals may contain
+// []byte, int8, uint8, int16, uint16, int32, uint32, or time.Time, and
+// Decr-wrapped versions of any of those.
+func Append(dst []byte, vals ...interface{}) ([]byte, error) {
+	for _, val := range vals {
+		var err error
+		dst, err = appendOne(dst, val)
+		if err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+func appendOne(dst []byte, val interface{}) ([]byte, error) {
+	if d, ok := val.(decr); ok {
+		return upstream.Append(dst, upstream.Decr(toUpstream(d.x)))
+	}
+	return upstream.Append(dst, toUpstream(val))
+}
+
+// toUpstream rewrites a value of one of this package's extra types into
+// the upstream type with the same order-preserving encoding, leaving any
+// value upstream already handles untouched.
+func toUpstream(val interface{}) interface{} {
+	switch v := val.(type) {
+	case []byte:
+		return string(v)
+	case int8:
+		return int64(v)
+	case uint8:
+		return uint64(v)
+	case int16:
+		return int64(v)
+	case uint16:
+		return uint64(v)
+	case int32:
+		return int64(v)
+	case uint32:
+		return uint64(v)
+	case time.Time:
+		return v.UTC().UnixNano()
+	default:
+		return val
+	}
+}
+
+// Parse parses the encoding in src, storing the decoded values in vals,
+// and returns any unparsed suffix of src.
+func Parse(src string, vals ...interface{}) (string, error) {
+	for _, val := range vals {
+		var err error
+		src, err = parseOne(src, val)
+		if err != nil {
+			return src, err
+		}
+	}
+	return src, nil
+}
+
+func parseOne(src string, val interface{}) (string, error) {
+	if d, ok := val.(decr); ok {
+		return parseExtra(src, d.x, true)
+	}
+	return parseExtra(src, val, false)
+}
+
+// parseExtra handles this package's extra pointer types itself, parsing an
+// upstream-supported intermediate value and converting it back, and
+// delegates anything else straight to upstream.
+func parseExtra(src string, val interface{}, isDecr bool) (string, error) {
+	switch v := val.(type) {
+	case *[]byte:
+		var s string
+		rest, err := parseUpstream(src, &s, isDecr)
+		if err != nil {
+			return src, errCorrupt
+		}
+		*v = []byte(s)
+		return rest, nil
+	case *int8:
+		var i int64
+		rest, err := parseUpstream(src, &i, isDecr)
+		if err != nil {
+			return src, errCorrupt
+		}
+		if i < math.MinInt8 || i > math.MaxInt8 {
+			return src, errCorrupt
+		}
+		*v = int8(i)
+		return rest, nil
+	case *uint8:
+		var u uint64
+		rest, err := parseUpstream(src, &u, isDecr)
+		if err != nil {
+			return src, errCorrupt
+		}
+		if u > math.MaxUint8 {
+			return src, errCorrupt
+		}
+		*v = uint8(u)
+		return rest, nil
+	case *int16:
+		var i int64
+		rest, err := parseUpstream(src, &i, isDecr)
+		if err != nil {
+			return src, errCorrupt
+		}
+		if i < math.MinInt16 || i > math.MaxInt16 {
+			return src, errCorrupt
+		}
+		*v = int16(i)
+		return rest, nil
+	case *uint16:
+		var u uint64
+		rest, err := parseUpstream(src, &u, isDecr)
+		if err != nil {
+			return src, errCorrupt
+		}
+		if u > math.MaxUint16 {
+			return src, errCorrupt
+		}
+		*v = uint16(u)
+		return rest, nil
+	case *int32:
+		var i int64
+		rest, err := parseUpstream(src, &i, isDecr)
+		if err != nil {
+			return src, errCorrupt
+		}
+		if i < math.MinInt32 || i > math.MaxInt32 {
+			return src, errCorrupt
+		}
+		*v = int32(i)
+		return rest, nil
+	case *uint32:
+		var u uint64
+		rest, err := parseUpstream(src, &u, isDecr)
+		if err != nil {
+			return src, errCorrupt
+		}
+		if u > math.MaxUint32 {
+			return src, errCorrupt
+		}
+		*v = uint32(u)
+		return rest, nil
+	case *time.Time:
+		var i int64
+		rest, err := parseUpstream(src, &i, isDecr)
+		if err != nil {
+			return src, errCorrupt
+		}
+		*v = time.Unix(0, i).UTC()
+		return rest, nil
+	default:
+		return parseUpstream(src, val, isDecr)
+	}
+}
+
+func parseUpstream(src string, ptr interface{}, isDecr bool) (string, error) {
+	if isDecr {
+		return upstream.Parse(src, upstream.Decr(ptr))
+	}
+	return upstream.Parse(src, ptr)
+}
@@ -0,0 +1,239 @@
+package orderedcode
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBytesRoundTrip(t *testing.T) {
+	for _, decr := range []bool{false, true} {
+		for _, tc := range [][]byte{nil, {}, {0x00}, {0xff}, []byte("foobar")} {
+			var src interface{} = tc
+			if decr {
+				src = Decr(src)
+			}
+			buf, err := Append(nil, src)
+			if err != nil {
+				t.Fatalf("decr=%v, tc=%v: append: %v", decr, tc, err)
+			}
+
+			var got []byte
+			dst := interface{}(&got)
+			if decr {
+				dst = Decr(dst)
+			}
+			rem, err := Parse(string(buf), dst)
+			if err != nil {
+				t.Fatalf("decr=%v, tc=%v: parse: %v", decr, tc, err)
+			}
+			if rem != "" {
+				t.Fatalf("decr=%v, tc=%v: parse: got remainder %q", decr, tc, rem)
+			}
+			if !bytes.Equal(got, tc) {
+				t.Fatalf("decr=%v, tc=%v: got %v", decr, tc, got)
+			}
+		}
+	}
+
+	// []byte and string must encode identically.
+	b, err := Append(nil, []byte("foo\x00bar"))
+	if err != nil {
+		t.Fatalf("append []byte: %v", err)
+	}
+	s, err := Append(nil, "foo\x00bar")
+	if err != nil {
+		t.Fatalf("append string: %v", err)
+	}
+	if !bytes.Equal(b, s) {
+		t.Errorf("[]byte and string encodings differ: % x vs % x", b, s)
+	}
+}
+
+func TestFixedWidthIntegers(t *testing.T) {
+	testInt32 := []int32{math.MinInt32, -1, 0, 1, math.MaxInt32}
+	testUint32 := []uint32{0, 1, math.MaxUint32}
+	testInt16 := []int16{math.MinInt16, -1, 0, 1, math.MaxInt16}
+	testUint16 := []uint16{0, 1, math.MaxUint16}
+	testInt8 := []int8{math.MinInt8, -1, 0, 1, math.MaxInt8}
+	testUint8 := []uint8{0, 1, math.MaxUint8}
+
+	for _, tc := range testInt32 {
+		checkFixedWidthRoundTrip(t, tc, new(int32))
+	}
+	for _, tc := range testUint32 {
+		checkFixedWidthRoundTrip(t, tc, new(uint32))
+	}
+	for _, tc := range testInt16 {
+		checkFixedWidthRoundTrip(t, tc, new(int16))
+	}
+	for _, tc := range testUint16 {
+		checkFixedWidthRoundTrip(t, tc, new(uint16))
+	}
+	for _, tc := range testInt8 {
+		checkFixedWidthRoundTrip(t, tc, new(int8))
+	}
+	for _, tc := range testUint8 {
+		checkFixedWidthRoundTrip(t, tc, new(uint8))
+	}
+
+	// Encoding must preserve numeric order, same as the int64/uint64 case.
+	lo, err := Append(nil, int32(-1))
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	hi, err := Append(nil, int32(1))
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if string(lo) >= string(hi) {
+		t.Errorf("int32 order violated: % x >= % x", lo, hi)
+	}
+}
+
+func checkFixedWidthRoundTrip(t *testing.T, val interface{}, dst interface{}) {
+	t.Helper()
+	buf, err := Append(nil, val)
+	if err != nil {
+		t.Fatalf("val=%v of type %T: append: %v", val, val, err)
+	}
+	rem, err := Parse(string(buf), dst)
+	if err != nil {
+		t.Fatalf("val=%v of type %T: parse: %v", val, val, err)
+	}
+	if rem != "" {
+		t.Fatalf("val=%v of type %T: parse: got remainder %q", val, val, rem)
+	}
+	got := reflect.ValueOf(dst).Elem().Interface()
+	if !reflect.DeepEqual(got, val) {
+		t.Fatalf("val=%v of type %T: got %v", val, val, got)
+	}
+}
+
+func TestTimeRoundTrip(t *testing.T) {
+	testCases := []time.Time{
+		time.Unix(0, 0).UTC(),
+		time.Date(1970, 1, 1, 0, 0, 0, 1, time.UTC),
+		time.Date(2023, 6, 15, 12, 30, 0, 0, time.UTC),
+		time.Date(2023, 6, 15, 12, 30, 0, 0, time.FixedZone("PST", -8*60*60)),
+	}
+	for _, tc := range testCases {
+		buf, err := Append(nil, tc)
+		if err != nil {
+			t.Fatalf("tc=%v: append: %v", tc, err)
+		}
+		var got time.Time
+		rem, err := Parse(string(buf), &got)
+		if err != nil {
+			t.Fatalf("tc=%v: parse: %v", tc, err)
+		}
+		if rem != "" {
+			t.Fatalf("tc=%v: parse: got remainder %q", tc, rem)
+		}
+		if !got.Equal(tc) {
+			t.Fatalf("tc=%v: got %v", tc, got)
+		}
+	}
+
+	// Ordering must match chronological order, regardless of location.
+	earlier, err := Append(nil, time.Date(2023, 6, 15, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	later, err := Append(nil, time.Date(2023, 6, 15, 13, 0, 0, 0, time.FixedZone("PST", -8*60*60)))
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if string(earlier) >= string(later) {
+		t.Errorf("time.Time order violated: % x >= % x", earlier, later)
+	}
+}
+
+func TestCorruptNewTypes(t *testing.T) {
+	testCases := []struct {
+		dst    interface{}
+		inputs []string
+	}{
+		{
+			new([]byte),
+			[]string{
+				"",
+				"\x00",
+				"abc",
+				"\xa3",
+				"\xff\xff", // A valid infinity, but not a valid []byte.
+			},
+		},
+		{
+			new(int8),
+			[]string{
+				"",
+				"\x00",     // A valid uint64, but not a valid int8.
+				"\xc0\x80", // A valid int64 (+128), out of range for int8.
+				"\x3f\x7f", // A valid int64 (-129), out of range for int8.
+				"\xff\xff", // A valid infinity, but not a valid int8.
+			},
+		},
+		{
+			new(uint8),
+			[]string{
+				"",
+				"\x02\x01\x00", // A valid uint64 (256), out of range for uint8.
+				"\xff\xff",     // A valid infinity, but not a valid uint8.
+			},
+		},
+		{
+			new(int16),
+			[]string{
+				"",
+				"\x00",
+				"\xe0\x80\x00", // A valid int64 (+1<<15), out of range for int16.
+				"\x1f\x7f\xff", // A valid int64 (-1<<15 - 1), out of range for int16.
+				"\xff\xff",
+			},
+		},
+		{
+			new(uint16),
+			[]string{
+				"",
+				"\x03\x01\x00\x00", // A valid uint64 (1<<16), out of range for uint16.
+				"\xff\xff",
+			},
+		},
+		{
+			new(int32),
+			[]string{
+				"",
+				"\x00",
+				"\xf8\x80\x00\x00\x00", // A valid int64 (+1<<31), out of range for int32.
+				"\a\x7f\xff\xff\xff",   // A valid int64 (-1<<31 - 1), out of range for int32.
+				"\xff\xff",
+			},
+		},
+		{
+			new(uint32),
+			[]string{
+				"",
+				"\x05\x01\x00\x00\x00\x00", // A valid uint64 (1<<32), out of range for uint32.
+				"\xff\xff",
+			},
+		},
+		{
+			new(time.Time),
+			[]string{
+				"",
+				"\x00\x00",
+				"\xff\xff", // A valid infinity, but not a valid time.Time.
+			},
+		},
+	}
+	for _, tc := range testCases {
+		for _, input := range tc.inputs {
+			if _, err := Parse(input, tc.dst); err != errCorrupt {
+				t.Errorf("dst has type %T, input=%q: got %v want errCorrupt", tc.dst, input, err)
+			}
+		}
+	}
+}
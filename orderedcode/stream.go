@@ -0,0 +1,81 @@
+package orderedcode
+
+import (
+	"bufio"
+	"io"
+)
+
+// Encoder writes a stream of ordered-code encoded values to an
+// underlying io.Writer. It is useful when building up a composite key
+// incrementally, such as inside an SSTable writer, where allocating a
+// whole key slice up front is inconvenient.
+type Encoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewEncoder returns a new Encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode appends the ordered-code encoding of each of vals, in order, and
+// writes the result directly to the underlying io.Writer. vals may be any
+// of the types supported by Append, including Decr-wrapped values.
+func (e *Encoder) Encode(vals ...interface{}) error {
+	buf, err := Append(e.buf[:0], vals...)
+	if err != nil {
+		return err
+	}
+	e.buf = buf
+	_, err = e.w.Write(buf)
+	return err
+}
+
+// Decoder reads a stream of ordered-code encoded values from an
+// underlying io.Reader, such as when scanning a large stream of keys
+// without wanting to hold every key's bytes in memory at once.
+type Decoder struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+// NewDecoder returns a new Decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Decode reads and decodes vals, in order, from the underlying io.Reader.
+// Each value is decoded as soon as enough bytes have been read for it;
+// Decode never reads ahead into the next value's encoding.
+func (d *Decoder) Decode(vals ...interface{}) error {
+	for _, val := range vals {
+		if err := d.decodeOne(val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeOne grows d.buf one byte at a time, re-attempting Parse after each
+// read, until val can be fully decoded. Any bytes left over after val are
+// kept in d.buf for the next call.
+func (d *Decoder) decodeOne(val interface{}) error {
+	for {
+		if len(d.buf) > 0 {
+			rem, err := Parse(string(d.buf), val)
+			if err == nil {
+				d.buf = append(d.buf[:0], rem...)
+				return nil
+			}
+		}
+		b, err := d.r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		d.buf = append(d.buf, b)
+	}
+}
@@ -0,0 +1,67 @@
+package orderedcode
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestEncoderDecoderRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	type row struct {
+		key string
+		seq int64
+	}
+	rows := []row{{"a", 1}, {"bb", 2}, {"ccc", 3}}
+	for _, r := range rows {
+		if err := enc.Encode(r.key, Decr(r.seq)); err != nil {
+			t.Fatalf("Encode(%+v): %v", r, err)
+		}
+	}
+
+	dec := NewDecoder(&buf)
+	for _, want := range rows {
+		var key string
+		var seq int64
+		if err := dec.Decode(&key, Decr(&seq)); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		if key != want.key || seq != want.seq {
+			t.Errorf("Decode = {%q, %d}, want {%q, %d}", key, seq, want.key, want.seq)
+		}
+	}
+}
+
+func TestDecoderUnexpectedEOF(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.Encode("a"); err != nil {
+		t.Fatal(err)
+	}
+	firstLen := buf.Len()
+	if err := enc.Encode("b"); err != nil {
+		t.Fatal(err)
+	}
+	// Truncate the second value's encoding by one byte, so decoding it can
+	// never complete.
+	truncated := bytes.NewReader(buf.Bytes()[:buf.Len()-1])
+	if firstLen >= truncated.Len() {
+		t.Fatalf("test setup: first value's encoding (%d bytes) should be shorter than the truncated stream (%d bytes)", firstLen, truncated.Len())
+	}
+
+	dec := NewDecoder(truncated)
+	var got string
+	if err := dec.Decode(&got); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if got != "a" {
+		t.Fatalf("Decode = %q, want %q", got, "a")
+	}
+
+	var extra string
+	if err := dec.Decode(&extra); err != io.ErrUnexpectedEOF {
+		t.Errorf("Decode past EOF = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
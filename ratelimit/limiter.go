@@ -0,0 +1,186 @@
+// Package ratelimit provides a token-bucket rate limiter used to cap the
+// bandwidth consumed by background jobs (compaction, WAL cleanup, etc) so
+// they don't starve foreground read/write latency.
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter throttles callers to a configured rate of bytes (or any other
+// unit) per second.
+type Limiter interface {
+	// WaitN blocks until n units are available, the limit allows it
+	// immediately, or ctx is done. Returns ctx.Err() if ctx is done first.
+	WaitN(ctx context.Context, n int64) error
+
+	// AllowN reports whether n units are available right now, consuming them
+	// if so, and never blocks. Unlike WaitN, callers that are refused must
+	// decide for themselves whether to reject the caller or retry later.
+	AllowN(n int64) bool
+
+	// SetLimit changes the allowed rate, for online tuning.
+	SetLimit(unitsPerSec int64)
+
+	// Rate returns an exponential moving average of the observed throughput,
+	// in units per second.
+	Rate() float64
+
+	// Utilization returns Rate() as a fraction of the configured limit, e.g.
+	// 0.5 means observed throughput is running at half the configured rate.
+	// Returns 0 for an unlimited Limiter, since there's no ceiling to be a
+	// fraction of.
+	Utilization() float64
+}
+
+// emaAlpha weights the most recent observation against the running average.
+// Lower values smooth out bursts more aggressively.
+const emaAlpha = 0.2
+
+// tokenBucket is a Limiter implementing the classic token bucket algorithm:
+// tokens accumulate at rate units/sec up to burst, and WaitN blocks until
+// enough tokens are available.
+type tokenBucket struct {
+	mu sync.Mutex
+
+	rate  float64 // units/sec
+	burst float64
+
+	tokens float64
+	last   time.Time
+
+	ema float64
+}
+
+// New returns a Limiter that allows unitsPerSec units per second, with
+// bursting up to unitsPerSec (one second worth of tokens).
+func New(unitsPerSec int64) Limiter {
+	return NewWithBurst(unitsPerSec, unitsPerSec)
+}
+
+// NewWithBurst returns a Limiter that allows unitsPerSec units per second on
+// average, but can burst up to burst units instantaneously.
+func NewWithBurst(unitsPerSec, burst int64) Limiter {
+	return &tokenBucket{
+		rate:   float64(unitsPerSec),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (l *tokenBucket) SetLimit(unitsPerSec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refillLocked()
+	l.rate = float64(unitsPerSec)
+}
+
+func (l *tokenBucket) Rate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ema
+}
+
+func (l *tokenBucket) Utilization() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	return l.ema / l.rate
+}
+
+// refillLocked adds tokens accumulated since the last call, capped at burst.
+// l.mu must be held.
+func (l *tokenBucket) refillLocked() {
+	now := time.Now()
+	elapsed := now.Sub(l.last).Seconds()
+	l.last = now
+
+	l.tokens += elapsed * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+func (l *tokenBucket) WaitN(ctx context.Context, n int64) error {
+	for {
+		l.mu.Lock()
+		l.refillLocked()
+
+		if l.rate <= 0 {
+			// Unlimited.
+			l.tokens -= float64(n)
+			l.recordLocked(n)
+			l.mu.Unlock()
+			return nil
+		}
+
+		if l.tokens >= float64(n) {
+			l.tokens -= float64(n)
+			l.recordLocked(n)
+			l.mu.Unlock()
+			return nil
+		}
+
+		need := float64(n) - l.tokens
+		wait := time.Duration(need / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+			// loop around and re-check, in case SetLimit changed things or
+			// another waiter consumed tokens in the meantime.
+		}
+	}
+}
+
+func (l *tokenBucket) AllowN(n int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refillLocked()
+
+	if l.rate <= 0 {
+		// Unlimited.
+		l.tokens -= float64(n)
+		l.recordLocked(n)
+		return true
+	}
+
+	if l.tokens < float64(n) {
+		return false
+	}
+	l.tokens -= float64(n)
+	l.recordLocked(n)
+	return true
+}
+
+// recordLocked updates the observed-rate EMA with a new sample of n units
+// consumed "now". l.mu must be held.
+func (l *tokenBucket) recordLocked(n int64) {
+	// Treat each call as an instantaneous sample of n units/sec; smoothed by
+	// the EMA this approximates sustained throughput without needing a
+	// separate sampling goroutine.
+	sample := float64(n)
+	l.ema = emaAlpha*sample + (1-emaAlpha)*l.ema
+}
+
+// nopLimiter never blocks. Used by callers that don't want throttling, e.g.
+// in tests.
+type nopLimiter struct{}
+
+// Nop returns a Limiter that never throttles.
+func Nop() Limiter { return nopLimiter{} }
+
+func (nopLimiter) WaitN(ctx context.Context, n int64) error { return nil }
+func (nopLimiter) AllowN(n int64) bool                      { return true }
+func (nopLimiter) SetLimit(unitsPerSec int64)               {}
+func (nopLimiter) Rate() float64                            { return 0 }
+func (nopLimiter) Utilization() float64                     { return 0 }
@@ -0,0 +1,83 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWaitNWithinBurst(t *testing.T) {
+	l := New(1000)
+
+	start := time.Now()
+	if err := l.WaitN(context.Background(), 500); err != nil {
+		t.Fatalf("WaitN returned error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("WaitN within burst took %v, want near-instant", elapsed)
+	}
+}
+
+func TestWaitNBlocksUntilRefill(t *testing.T) {
+	l := NewWithBurst(1000, 10)
+
+	if err := l.WaitN(context.Background(), 10); err != nil {
+		t.Fatalf("WaitN returned error: %v", err)
+	}
+
+	start := time.Now()
+	if err := l.WaitN(context.Background(), 10); err != nil {
+		t.Fatalf("WaitN returned error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 5*time.Millisecond {
+		t.Errorf("WaitN returned immediately, want it to wait for refill (took %v)", elapsed)
+	}
+}
+
+func TestWaitNCancelled(t *testing.T) {
+	l := NewWithBurst(1, 1)
+	l.WaitN(context.Background(), 1) // drain the burst
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := l.WaitN(ctx, 100); err != ctx.Err() {
+		t.Errorf("WaitN()=%v, want context deadline error", err)
+	}
+}
+
+func TestAllowNWithinBurst(t *testing.T) {
+	l := NewWithBurst(1000, 10)
+
+	if !l.AllowN(10) {
+		t.Error("AllowN(10) = false, want true within burst")
+	}
+	if l.AllowN(10) {
+		t.Error("AllowN(10) = true, want false: burst already spent")
+	}
+}
+
+func TestAllowNNeverBlocks(t *testing.T) {
+	l := NewWithBurst(1000, 1)
+	l.AllowN(1) // drain the burst
+
+	start := time.Now()
+	allowed := l.AllowN(1000)
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("AllowN blocked for %v, want immediate return", elapsed)
+	}
+	if allowed {
+		t.Error("AllowN(1000) = true, want false: far beyond burst")
+	}
+}
+
+func TestNopNeverBlocks(t *testing.T) {
+	l := Nop()
+	start := time.Now()
+	if err := l.WaitN(context.Background(), 1<<30); err != nil {
+		t.Fatalf("WaitN returned error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("Nop limiter blocked for %v", elapsed)
+	}
+}
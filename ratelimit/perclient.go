@@ -0,0 +1,154 @@
+package ratelimit
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// idleTTL is how long a client key can go unused before its bucket is
+// evicted. Long enough that a client making steady but infrequent requests
+// (e.g. one write every few seconds) keeps its accumulated rate history,
+// short enough that a map grown by connection churn (see clientIdleSweep)
+// drains back down on its own.
+const idleTTL = 10 * time.Minute
+
+// idleSweepInterval is how often PerClientLimiter checks for idle buckets
+// to evict.
+const idleSweepInterval = 1 * time.Minute
+
+// PerClientLimits configures the byte/s and ops/s ceilings a
+// PerClientLimiter enforces for each client key. Burst defaults to one
+// second's worth of the corresponding ceiling if left 0. A ceiling <= 0
+// leaves that dimension unlimited.
+type PerClientLimits struct {
+	BytesPerSec int64
+	BytesBurst  int64
+	OpsPerSec   int64
+	OpsBurst    int64
+}
+
+// PerClientLimiter enforces PerClientLimits independently for each client
+// key (e.g. a peer address or tenant ID), so one hot client can be
+// throttled without capping everyone else's share of a shared resource. The
+// zero value rejects everything; use NewPerClient. Safe for concurrent use.
+type PerClientLimiter struct {
+	limits PerClientLimits
+
+	mu      sync.Mutex
+	clients map[string]*clientBucket
+}
+
+type clientBucket struct {
+	bytes Limiter
+	ops   Limiter
+
+	// lastUsed is the last time Allow touched this bucket, guarded by
+	// PerClientLimiter.mu rather than its own lock since it's only ever
+	// read/written alongside a clients map lookup.
+	lastUsed time.Time
+}
+
+// NewPerClient returns a PerClientLimiter enforcing limits for every client
+// key it sees. It starts a background goroutine that evicts buckets idle
+// past idleTTL, so a key that churns (e.g. one derived from an ephemeral
+// port that changes on every reconnect) doesn't grow the client map
+// without bound.
+func NewPerClient(limits PerClientLimits) *PerClientLimiter {
+	if limits.BytesBurst <= 0 {
+		limits.BytesBurst = limits.BytesPerSec
+	}
+	if limits.OpsBurst <= 0 {
+		limits.OpsBurst = limits.OpsPerSec
+	}
+	p := &PerClientLimiter{limits: limits, clients: make(map[string]*clientBucket)}
+	go p.evictIdleLoop()
+	return p
+}
+
+// evictIdleLoop periodically removes client buckets that haven't been used
+// in idleTTL. Runs for the lifetime of the process, same as
+// database.compactor.
+func (p *PerClientLimiter) evictIdleLoop() {
+	ticker := time.NewTicker(idleSweepInterval)
+	for range ticker.C {
+		p.evictIdle(time.Now())
+	}
+}
+
+func (p *PerClientLimiter) evictIdle(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, c := range p.clients {
+		if now.Sub(c.lastUsed) > idleTTL {
+			delete(p.clients, k)
+		}
+	}
+}
+
+// Allow reports whether key may send an operation of n bytes right now,
+// under both the byte/s and ops/s ceilings, consuming a token from each
+// bucket if so. It never blocks. A nil PerClientLimiter always allows, so
+// callers can hold one unconditionally and only pay for the map lookup when
+// limits are actually configured.
+func (p *PerClientLimiter) Allow(key string, n int64) bool {
+	if p == nil {
+		return true
+	}
+
+	c := p.clientBucket(key)
+	// Check the ops bucket first: a request refused for being too big
+	// shouldn't also burn an ops token it was never credited for.
+	if !c.ops.AllowN(1) {
+		return false
+	}
+	return c.bytes.AllowN(n)
+}
+
+func (p *PerClientLimiter) clientBucket(key string) *clientBucket {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c, ok := p.clients[key]
+	if !ok {
+		c = &clientBucket{
+			bytes: NewWithBurst(p.limits.BytesPerSec, p.limits.BytesBurst),
+			ops:   NewWithBurst(p.limits.OpsPerSec, p.limits.OpsBurst),
+		}
+		p.clients[key] = c
+	}
+	c.lastUsed = time.Now()
+	return c
+}
+
+// ClientStats is a point-in-time snapshot of one client's observed rate,
+// e.g. for rendering on a /debug HTTP surface.
+type ClientStats struct {
+	Key              string
+	BytesPerSec      float64
+	BytesUtilization float64
+	OpsPerSec        float64
+}
+
+// Stats returns a snapshot of every client key PerClientLimiter has seen so
+// far, sorted by key. A nil PerClientLimiter returns nil.
+func (p *PerClientLimiter) Stats() []ClientStats {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	out := make([]ClientStats, 0, len(p.clients))
+	for k, c := range p.clients {
+		out = append(out, ClientStats{
+			Key:              k,
+			BytesPerSec:      c.bytes.Rate(),
+			BytesUtilization: c.bytes.Utilization(),
+			OpsPerSec:        c.ops.Rate(),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
@@ -0,0 +1,67 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPerClientLimiterIsolatesClients(t *testing.T) {
+	p := NewPerClient(PerClientLimits{BytesPerSec: 100, BytesBurst: 100, OpsPerSec: 100, OpsBurst: 100})
+
+	if !p.Allow("a", 100) {
+		t.Fatal("Allow(a, 100) = false, want true within burst")
+	}
+	if p.Allow("a", 1) {
+		t.Error("Allow(a, 1) = true, want false: a's burst is spent")
+	}
+	if !p.Allow("b", 100) {
+		t.Error("Allow(b, 100) = false, want true: b has its own bucket, unaffected by a")
+	}
+}
+
+func TestPerClientLimiterOpsCeiling(t *testing.T) {
+	p := NewPerClient(PerClientLimits{BytesPerSec: 0, OpsPerSec: 1, OpsBurst: 1})
+
+	if !p.Allow("a", 1<<20) {
+		t.Fatal("Allow(a, big) = false, want true: bytes unlimited, ops burst available")
+	}
+	if p.Allow("a", 1) {
+		t.Error("Allow(a, 1) = true, want false: ops burst spent even though bytes are unlimited")
+	}
+}
+
+func TestPerClientLimiterEvictsIdleClients(t *testing.T) {
+	p := NewPerClient(PerClientLimits{BytesPerSec: 100, BytesBurst: 100, OpsPerSec: 100, OpsBurst: 100})
+
+	p.Allow("idle", 1)
+	p.Allow("active", 1)
+
+	p.mu.Lock()
+	if len(p.clients) != 2 {
+		t.Fatalf("len(p.clients) = %d, want 2", len(p.clients))
+	}
+	p.clients["active"].lastUsed = time.Now()
+	p.clients["idle"].lastUsed = time.Now().Add(-2 * idleTTL)
+	p.mu.Unlock()
+
+	p.evictIdle(time.Now())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.clients["idle"]; ok {
+		t.Error("evictIdle should have removed the idle client's bucket")
+	}
+	if _, ok := p.clients["active"]; !ok {
+		t.Error("evictIdle should not remove a recently-used client's bucket")
+	}
+}
+
+func TestNilPerClientLimiterAlwaysAllows(t *testing.T) {
+	var p *PerClientLimiter
+	if !p.Allow("a", 1<<30) {
+		t.Error("nil PerClientLimiter should always allow")
+	}
+	if p.Stats() != nil {
+		t.Error("nil PerClientLimiter.Stats() should be nil")
+	}
+}
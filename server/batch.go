@@ -0,0 +1,70 @@
+//    Copyright 2018 Google Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package server
+
+import pb "github.com/danchia/ddb/proto"
+
+// WriteBatch accumulates a sequence of Put/Delete mutations to be committed
+// atomically by database.Write: every mutation in the batch is marshalled
+// into a single WAL record and applied to the memtable as one unit,
+// sharing a single timestamp and log sequence number, so a reader can
+// never observe some but not all of the batch. Analogous to goleveldb's
+// Batch.
+//
+// The zero value is an empty, ready to use batch.
+type WriteBatch struct {
+	mutations []*pb.Mutation
+}
+
+// NewWriteBatch returns an empty WriteBatch.
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Put stages setting key to value.
+func (b *WriteBatch) Put(key string, value []byte) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	if err := validateValue(value); err != nil {
+		return err
+	}
+	b.mutations = append(b.mutations, &pb.Mutation{Key: key, Value: value, Type: pb.Mutation_PUT})
+	return nil
+}
+
+// Delete stages deleting key.
+func (b *WriteBatch) Delete(key string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	b.mutations = append(b.mutations, &pb.Mutation{Key: key, Type: pb.Mutation_DELETE})
+	return nil
+}
+
+// Len returns the number of mutations staged in b.
+func (b *WriteBatch) Len() int {
+	return len(b.mutations)
+}
+
+// byteSize returns the summed key+value size of every mutation staged in b,
+// for accounting against Options.PerClientWriteLimits.
+func (b *WriteBatch) byteSize() int64 {
+	var n int64
+	for _, m := range b.mutations {
+		n += int64(len(m.Key)) + int64(len(m.Value))
+	}
+	return n
+}
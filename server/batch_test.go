@@ -0,0 +1,89 @@
+//    Copyright 2018 Google Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	pb "github.com/danchia/ddb/proto"
+)
+
+func TestWriteBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batchtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewServer(DefaultOptions(dir))
+
+	if _, err := s.Set(context.Background(), &pb.SetRequest{Key: "b", Value: []byte("old")}); err != nil {
+		t.Fatalf("Set(b): %v", err)
+	}
+
+	batch := NewWriteBatch()
+	if err := batch.Put("a", []byte("1")); err != nil {
+		t.Fatalf("Put(a): %v", err)
+	}
+	if err := batch.Delete("b"); err != nil {
+		t.Fatalf("Delete(b): %v", err)
+	}
+	if err := batch.Put("c", []byte("3")); err != nil {
+		t.Fatalf("Put(c): %v", err)
+	}
+
+	if _, err := s.Write(context.Background(), batch); err != nil {
+		t.Fatalf("Write(batch): %v", err)
+	}
+
+	for _, tt := range []struct {
+		key      string
+		wantVal  string
+		wantFind bool
+	}{
+		{"a", "1", true},
+		{"b", "", false},
+		{"c", "3", true},
+	} {
+		r, err := s.Get(context.Background(), &pb.GetRequest{Key: tt.key})
+		if !tt.wantFind {
+			if err == nil {
+				t.Errorf("Get(%v) = %v, want NotFound", tt.key, r)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Get(%v): %v", tt.key, err)
+		}
+		if string(r.Value) != tt.wantVal {
+			t.Errorf("Get(%v) = %q, want %q", tt.key, r.Value, tt.wantVal)
+		}
+	}
+}
+
+func TestWriteBatchEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batchtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewServer(DefaultOptions(dir))
+
+	if _, err := s.Write(context.Background(), NewWriteBatch()); err != nil {
+		t.Fatalf("Write(empty batch): %v", err)
+	}
+}
@@ -0,0 +1,451 @@
+//    Copyright 2018 Google Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	pb "github.com/danchia/ddb/proto"
+	"github.com/danchia/ddb/sst"
+	"github.com/golang/glog"
+)
+
+// sstFile is an on-disk SST tracked by database, annotated with the
+// compaction level it lives in and the key range it covers, so Find and
+// compaction can skip files that can't possibly hold a given key without
+// opening them.
+//
+// Level and key range aren't persisted in pb.SstMeta: the ddb.proto this
+// server is generated from isn't part of this checkout to extend (see the
+// pb import in descriptor.go, and the same note on Server.Scan in
+// server.go). So every SST is re-assigned to L0 on restart, see
+// newDatabase; the compactor naturally re-levels them from there.
+type sstFile struct {
+	r *sst.Reader
+
+	minKey, maxKey string
+
+	// appliedUntil is the highest WAL sequence number reflected in r,
+	// carried over from pb.SstMeta.AppliedUntil so recovery can still skip
+	// already-applied log records after a compaction rewrites the file.
+	appliedUntil int64
+}
+
+// containsKey returns whether f could hold key.
+func (f *sstFile) containsKey(key string) bool {
+	return key >= f.minKey && key <= f.maxKey
+}
+
+// overlaps returns whether f's key range intersects [start, end). An empty
+// end means unbounded above.
+func (f *sstFile) overlaps(start, end string) bool {
+	if end != "" && f.minKey >= end {
+		return false
+	}
+	if start != "" && f.maxKey < start {
+		return false
+	}
+	return true
+}
+
+// levelTargetSizeBytes returns the total size level n (n >= 1) should stay
+// under before compactLevel picks a file out of it. Ln's target is
+// opts.L1TargetSizeBytes * opts.LevelSizeMultiplier^(n-1), the usual
+// size-tiered LSM scheme (cf. LevelDB/RocksDB's db_compaction).
+func (o Options) levelTargetSizeBytes(n int) int64 {
+	target := o.L1TargetSizeBytes
+	for i := 1; i < n; i++ {
+		target *= o.LevelSizeMultiplier
+	}
+	return target
+}
+
+// maybeCompact runs at most one compaction job: L0 takes priority over every
+// Ln since its files can overlap arbitrarily and so are the most expensive
+// to leave unmerged.
+func (d *database) maybeCompact() {
+	d.mu.RLock()
+	l0Count := len(d.levels[0])
+	d.mu.RUnlock()
+
+	if l0Count > d.opts.L0CompactionFileCount {
+		d.compactL0()
+		return
+	}
+
+	for n := 1; ; n++ {
+		d.mu.RLock()
+		if n >= len(d.levels) {
+			d.mu.RUnlock()
+			return
+		}
+		size := levelSizeBytesLocked(d.levels[n])
+		d.mu.RUnlock()
+
+		if size > d.opts.levelTargetSizeBytes(n) {
+			d.compactLevel(n)
+			return
+		}
+	}
+}
+
+func levelSizeBytesLocked(level []*sstFile) int64 {
+	var total int64
+	for _, f := range level {
+		total += f.r.SizeBytes()
+	}
+	return total
+}
+
+// compactL0 merges every L0 file with every L1 file into a new, disjoint L1.
+// L0 files can individually span the whole keyspace, so rather than compute
+// a precise overlap set this conservatively takes all of L1 too: L0 is kept
+// small by L0CompactionFileCount, so this stays cheap, and it's the simplest
+// way to guarantee L1 comes out disjoint.
+func (d *database) compactL0() {
+	d.mu.RLock()
+	l0 := append([]*sstFile(nil), d.levels[0]...)
+	var l1 []*sstFile
+	if len(d.levels) > 1 {
+		l1 = append([]*sstFile(nil), d.levels[1]...)
+	}
+	d.mu.RUnlock()
+
+	inputs := append(append([]*sstFile(nil), l0...), l1...)
+	glog.Infof("Compacting %d L0 files and %d L1 files", len(l0), len(l1))
+
+	outs, err := d.mergeSstFiles(inputs)
+	if err != nil {
+		glog.Errorf("compactL0: %v", err)
+		return
+	}
+
+	d.mu.Lock()
+	d.levels[0] = removeSstFiles(d.levels[0], l0)
+	d.ensureLevelLocked(1)
+	l1After := removeSstFiles(d.levels[1], l1)
+	for _, out := range outs {
+		l1After = insertSortedByMinKey(l1After, out)
+	}
+	d.levels[1] = l1After
+	d.saveDescriptorLocked()
+	d.compactionCond.Broadcast()
+	d.mu.Unlock()
+
+	d.retireSstFiles(inputs)
+	glog.Infof("Compaction of L0 to L1 finished, produced %d file(s)", len(outs))
+}
+
+// compactLevel picks one file out of level n (n >= 1) using the rotating
+// compaction pointer, merges it with every overlapping file in level n+1,
+// and installs the result in level n+1. Spreading picks across the keyspace
+// this way, rather than always starting over from the smallest key, keeps
+// write amplification from concentrating on one key range.
+func (d *database) compactLevel(n int) {
+	d.mu.RLock()
+	picked := pickCompactionFileLocked(d.levels[n], d.compactPtr[n])
+	if picked == nil {
+		d.mu.RUnlock()
+		return
+	}
+	var overlapping []*sstFile
+	if len(d.levels) > n+1 {
+		for _, f := range d.levels[n+1] {
+			if f.overlaps(picked.minKey, exclusiveUpperBound(picked.maxKey)) {
+				overlapping = append(overlapping, f)
+			}
+		}
+	}
+	d.mu.RUnlock()
+
+	inputs := append([]*sstFile{picked}, overlapping...)
+	glog.Infof("Compacting 1 L%d file with %d overlapping L%d files", n, len(overlapping), n+1)
+
+	outs, err := d.mergeSstFiles(inputs)
+	if err != nil {
+		glog.Errorf("compactLevel(%d): %v", n, err)
+		return
+	}
+
+	d.mu.Lock()
+	d.levels[n] = removeSstFiles(d.levels[n], []*sstFile{picked})
+	d.ensureLevelLocked(n + 1)
+	nextAfter := removeSstFiles(d.levels[n+1], overlapping)
+	for _, out := range outs {
+		nextAfter = insertSortedByMinKey(nextAfter, out)
+	}
+	d.levels[n+1] = nextAfter
+	d.compactPtr[n] = picked.maxKey
+	d.saveDescriptorLocked()
+	d.compactionCond.Broadcast()
+	d.mu.Unlock()
+
+	d.retireSstFiles(inputs)
+	glog.Infof("Compaction of L%d to L%d finished, produced %d file(s)", n, n+1, len(outs))
+}
+
+// retireSstFiles drops compaction's own Ref on every input file, and evicts
+// their blocks from d.blockCache: once a compaction job's output has
+// replaced them in d.levels, their cached blocks are dead weight that would
+// otherwise only be reclaimed once the LRU happened to get around to them.
+// Any reader still using a file via a Snapshot holds its own Ref and keeps
+// the file itself open past this; only the cache entries are affected here.
+func (d *database) retireSstFiles(inputs []*sstFile) {
+	for _, f := range inputs {
+		if d.blockCache != nil {
+			d.blockCache.EvictID(f.r.CacheID())
+		}
+		f.r.UnRef()
+	}
+}
+
+// exclusiveUpperBound returns the smallest string greater than key under
+// byte-lexicographic order, for use as the end of a [start, end) range that
+// must include key itself.
+func exclusiveUpperBound(key string) string {
+	return key + "\x00"
+}
+
+// pickCompactionFileLocked returns the first file in level (sorted by
+// minKey) whose minKey is greater than ptr, wrapping around to the first
+// file if every file is <= ptr. Returns nil if level is empty.
+func pickCompactionFileLocked(level []*sstFile, ptr string) *sstFile {
+	if len(level) == 0 {
+		return nil
+	}
+	for _, f := range level {
+		if f.minKey > ptr {
+			return f
+		}
+	}
+	return level[0]
+}
+
+// removeSstFiles returns level with every file in remove excluded, by
+// identity.
+func removeSstFiles(level []*sstFile, remove []*sstFile) []*sstFile {
+	if len(remove) == 0 {
+		return level
+	}
+	drop := make(map[*sstFile]bool, len(remove))
+	for _, f := range remove {
+		drop[f] = true
+	}
+	var kept []*sstFile
+	for _, f := range level {
+		if !drop[f] {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// insertSortedByMinKey inserts f into level, keeping it sorted by minKey.
+// level's files must already be disjoint, and f must not overlap any of
+// them.
+func insertSortedByMinKey(level []*sstFile, f *sstFile) []*sstFile {
+	i := sort.Search(len(level), func(i int) bool { return level[i].minKey > f.minKey })
+	level = append(level, nil)
+	copy(level[i+1:], level[i:])
+	level[i] = f
+	return level
+}
+
+// ensureLevelLocked grows d.levels (and d.compactPtr) so level n exists.
+func (d *database) ensureLevelLocked(n int) {
+	for len(d.levels) <= n {
+		d.levels = append(d.levels, nil)
+		d.compactPtr = append(d.compactPtr, "")
+	}
+}
+
+// mergeSstFiles merges inputs with newMergingIter, dropping versions of a
+// key superseded within this merge and tombstones older than
+// Options.TombstoneGCGrace, and writes what's left to one or more fresh
+// SSTs capped at Options.CompactionTargetFileSizeBytes. Each returned
+// sstFile carries the key range and appliedUntil of the rows actually
+// written to it, carried over from whatever was merged.
+func (d *database) mergeSstFiles(inputs []*sstFile) ([]*sstFile, error) {
+	iters := make([]Iter, len(inputs))
+	for i, f := range inputs {
+		iter, err := f.r.NewIter()
+		if err != nil {
+			return nil, fmt.Errorf("opening iter for %v: %v", f.r.Filename(), err)
+		}
+		iters[i] = iter
+	}
+
+	mIter, err := newMergingIter(iters)
+	if err != nil {
+		return nil, fmt.Errorf("creating merge iter: %v", err)
+	}
+	defer mIter.Close()
+
+	maxApplied := int64(0)
+	for _, f := range inputs {
+		if f.appliedUntil > maxApplied {
+			maxApplied = f.appliedUntil
+		}
+	}
+
+	gcBefore := time.Now().UnixNano()/1000 - d.opts.TombstoneGCGrace.Microseconds()
+
+	w := newCompactionWriter(d, maxApplied)
+	defer w.abandon()
+
+	var lastKey string
+	haveLastKey := false
+	for mIter.Next() {
+		key, ts, value := mIter.Key(), mIter.Timestamp(), mIter.Value()
+
+		// mIter yields every version of key in (ts desc) order; only the
+		// first one seen per key is live, the rest are superseded by it and
+		// can be dropped here rather than carried forward forever.
+		if haveLastKey && key == lastKey {
+			continue
+		}
+		haveLastKey, lastKey = true, key
+
+		// A tombstone has to survive at least TombstoneGCGrace so that, once
+		// it's written out, any not-yet-compacted older version of key still
+		// sitting in an untouched level stays shadowed until a later
+		// compaction reaches it too (see Options.TombstoneGCGrace).
+		if value == nil && d.opts.TombstoneGCGrace > 0 && ts < gcBefore {
+			continue
+		}
+
+		if err := w.append(key, ts, value); err != nil {
+			return nil, err
+		}
+	}
+	if err := mIter.Err(); err != nil {
+		return nil, fmt.Errorf("merging inputs: %v", err)
+	}
+
+	return w.finish()
+}
+
+// compactionWriter wraps one or more sst.Writers, rolling over to a fresh
+// output file once the current one reaches Options.CompactionTargetFileSizeBytes,
+// so a single compaction job's result is spread across several disjoint
+// files instead of one ever-growing one.
+type compactionWriter struct {
+	d            *database
+	appliedUntil int64
+
+	cur   *sst.Writer
+	curFn string
+	out   []*sstFile
+}
+
+func newCompactionWriter(d *database, appliedUntil int64) *compactionWriter {
+	return &compactionWriter{d: d, appliedUntil: appliedUntil}
+}
+
+func (w *compactionWriter) append(key string, ts int64, value []byte) error {
+	if w.cur == nil {
+		if err := w.roll(); err != nil {
+			return err
+		}
+	}
+	if err := w.cur.Append(key, ts, value); err != nil {
+		return fmt.Errorf("appending to %v: %v", w.curFn, err)
+	}
+	if limit := w.d.opts.CompactionTargetFileSizeBytes; limit > 0 && w.cur.SizeBytes() > limit {
+		return w.closeCur()
+	}
+	return nil
+}
+
+// roll opens a fresh output SST, named after the current time like
+// flushIMemtable's output files.
+func (w *compactionWriter) roll() error {
+	fn := fmt.Sprintf("%020d.sst", time.Now().UnixNano())
+	fullFn := filepath.Join(w.d.opts.SstDir, fn)
+
+	writerOpts := sst.DefaultWriterOptions()
+	writerOpts.Limiter = w.d.compactionLimiter
+	writerOpts.TargetFPRate = w.d.opts.BloomTargetFPRate
+	writer, err := sst.NewWriterOptions(fullFn, writerOpts)
+	if err != nil {
+		return fmt.Errorf("opening writer for %v: %v", fullFn, err)
+	}
+	w.cur = writer
+	w.curFn = fullFn
+	return nil
+}
+
+// closeCur finalizes the current output file into an sstFile and clears
+// w.cur, so the next append starts a new one.
+func (w *compactionWriter) closeCur() error {
+	writer, fn := w.cur, w.curFn
+	w.cur, w.curFn = nil, ""
+
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("closing %v: %v", fn, err)
+	}
+	reader, err := sst.NewReader(fn, w.d.blockCache)
+	if err != nil {
+		return fmt.Errorf("opening freshly merged %v: %v", fn, err)
+	}
+	w.out = append(w.out, &sstFile{
+		r:            reader,
+		minKey:       writer.FirstKey(),
+		maxKey:       writer.LastKey(),
+		appliedUntil: w.appliedUntil,
+	})
+	return nil
+}
+
+// finish closes any still-open output file and returns every sstFile
+// produced. Every input row was either superseded, an expired tombstone, or
+// written out, so an empty input set (or one that merges down to nothing)
+// legitimately produces zero output files.
+func (w *compactionWriter) finish() ([]*sstFile, error) {
+	if w.cur != nil {
+		if err := w.closeCur(); err != nil {
+			return nil, err
+		}
+	}
+	return w.out, nil
+}
+
+// abandon closes a still-open output writer, so an error return from
+// mergeSstFiles (e.g. between appends) doesn't leak one; a no-op once
+// finish has already closed it.
+func (w *compactionWriter) abandon() {
+	if w.cur != nil {
+		w.cur.Close()
+		w.cur = nil
+	}
+}
+
+// saveDescriptorLocked rewrites the descriptor's SstMeta list from d.levels
+// and persists it. Must be called with d.mu held.
+func (d *database) saveDescriptorLocked() {
+	var metas []*pb.SstMeta
+	for _, level := range d.levels {
+		for _, f := range level {
+			metas = append(metas, &pb.SstMeta{Filename: filepath.Base(f.r.Filename()), AppliedUntil: f.appliedUntil})
+		}
+	}
+	d.descriptor.Current.SstMeta = metas
+	if err := d.descriptor.Save(); err != nil {
+		glog.Fatalf("error saving descriptor after compaction: %v", err)
+	}
+}
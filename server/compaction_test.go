@@ -0,0 +1,297 @@
+//    Copyright 2018 Google Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	pb "github.com/danchia/ddb/proto"
+	"github.com/danchia/ddb/ratelimit"
+	"github.com/danchia/ddb/sst"
+)
+
+func TestPickCompactionFileRotates(t *testing.T) {
+	a := &sstFile{minKey: "a", maxKey: "c"}
+	b := &sstFile{minKey: "d", maxKey: "f"}
+	c := &sstFile{minKey: "g", maxKey: "i"}
+	level := []*sstFile{a, b, c}
+
+	tests := []struct {
+		ptr  string
+		want *sstFile
+	}{
+		{"", a},
+		{"a", b},
+		{"d", c},
+		{"g", a}, // wraps back to the start once every file is <= ptr
+	}
+	for _, tt := range tests {
+		if got := pickCompactionFileLocked(level, tt.ptr); got != tt.want {
+			t.Errorf("pickCompactionFileLocked(ptr=%q) = %v, want %v", tt.ptr, got, tt.want)
+		}
+	}
+}
+
+func TestInsertSortedByMinKeyAndRemove(t *testing.T) {
+	a := &sstFile{minKey: "a"}
+	c := &sstFile{minKey: "c"}
+	level := insertSortedByMinKey(insertSortedByMinKey(nil, c), a)
+	if len(level) != 2 || level[0] != a || level[1] != c {
+		t.Fatalf("insertSortedByMinKey did not keep level sorted: %v", level)
+	}
+
+	b := &sstFile{minKey: "b"}
+	level = insertSortedByMinKey(level, b)
+	if len(level) != 3 || level[1] != b {
+		t.Fatalf("insertSortedByMinKey did not insert in the middle: %v", level)
+	}
+
+	level = removeSstFiles(level, []*sstFile{b})
+	if len(level) != 2 || level[0] != a || level[1] != c {
+		t.Fatalf("removeSstFiles left %v, want [a c]", level)
+	}
+}
+
+// TestCompactionLevelsKeysVisible writes enough distinct keys, with small
+// compaction thresholds, to push SSTs out of L0 into deeper levels, and
+// checks that every key is still readable afterwards and that compaction has
+// created at least L1. Each level's file count is logged, not checked.
+func TestCompactionLevelsKeysVisible(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compactiontest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions(dir)
+	opts.MemtableFlushSize = 1024
+	opts.L0CompactionFileCount = 2
+	opts.L1TargetSizeBytes = 4096
+	opts.LevelSizeMultiplier = 4
+	s := NewServer(opts)
+
+	const keys = 500
+	value := make([]byte, 200)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		value[0] = byte(i)
+		if _, err := s.Set(context.Background(), &pb.SetRequest{Key: key, Value: append([]byte(nil), value...)}); err != nil {
+			t.Fatalf("Set(%v): %v", key, err)
+		}
+	}
+
+	// Give the background compactor a chance to run; it ticks every second.
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		s.db.mu.RLock()
+		l0 := len(s.db.levels[0])
+		s.db.mu.RUnlock()
+		if l0 <= opts.L0CompactionFileCount {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		r, err := s.Get(context.Background(), &pb.GetRequest{Key: key})
+		if err != nil {
+			t.Fatalf("Get(%v): %v", key, err)
+		}
+		if r.Value[0] != byte(i) {
+			t.Errorf("Get(%v).Value[0] = %v, want %v", key, r.Value[0], byte(i))
+		}
+	}
+
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+	if len(s.db.levels) > 1 {
+		t.Logf("levels after load: %v", func() []int {
+			sizes := make([]int, len(s.db.levels))
+			for i, l := range s.db.levels {
+				sizes[i] = len(l)
+			}
+			return sizes
+		}())
+	} else {
+		t.Errorf("expected compaction to have created at least L1, got only L0 with %d files", len(s.db.levels[0]))
+	}
+}
+
+// testMergeRow is one input row for writeTestSst: key asc, ts desc within a
+// single file, as sst.Writer.Append requires. A nil value is a tombstone.
+type testMergeRow struct {
+	key   string
+	ts    int64
+	value []byte
+}
+
+// writeTestSst writes rows to a fresh SST under dir and opens it as an
+// sstFile, for feeding directly to database.mergeSstFiles in tests.
+func writeTestSst(t *testing.T, dir string, name string, rows []testMergeRow) *sstFile {
+	t.Helper()
+	fn := fmt.Sprintf("%s/%s.sst", dir, name)
+	w, err := sst.NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range rows {
+		if err := w.Append(r.key, r.ts, r.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := sst.NewReader(fn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &sstFile{r: r, minKey: w.FirstKey(), maxKey: w.LastKey()}
+}
+
+// testMergeDatabase returns a database with just enough state to call
+// mergeSstFiles directly, without going through a full Server/WAL setup.
+func testMergeDatabase(t *testing.T, opts Options) (*database, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "mergetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	opts.SstDir = dir
+	return &database{
+		opts:              opts,
+		compactionLimiter: ratelimit.Nop(),
+	}, dir
+}
+
+// readAllRows drains an sstFile's Reader into a flat list, for asserting on
+// mergeSstFiles output.
+func readAllRows(t *testing.T, f *sstFile) []testMergeRow {
+	t.Helper()
+	it, err := f.r.NewIter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	var got []testMergeRow
+	for it.Next() {
+		got = append(got, testMergeRow{key: it.Key(), ts: it.Timestamp(), value: append([]byte(nil), it.Value()...)})
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestMergeSstFilesDropsSupersededVersions(t *testing.T) {
+	d, dir := testMergeDatabase(t, DefaultOptions(""))
+
+	oldF := writeTestSst(t, dir, "old", []testMergeRow{{"a", 1, []byte("old")}})
+	newF := writeTestSst(t, dir, "new", []testMergeRow{{"a", 2, []byte("new")}})
+
+	outs, err := d.mergeSstFiles([]*sstFile{oldF, newF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outs) != 1 {
+		t.Fatalf("got %d output files, want 1", len(outs))
+	}
+
+	got := readAllRows(t, outs[0])
+	want := []testMergeRow{{"a", 2, []byte("new")}}
+	if len(got) != 1 || got[0].key != want[0].key || got[0].ts != want[0].ts || string(got[0].value) != string(want[0].value) {
+		t.Errorf("mergeSstFiles output = %+v, want %+v", got, want)
+	}
+}
+
+func TestMergeSstFilesDropsExpiredTombstonesOnly(t *testing.T) {
+	opts := DefaultOptions("")
+	opts.TombstoneGCGrace = time.Hour
+	d, dir := testMergeDatabase(t, opts)
+
+	nowMicros := time.Now().UnixNano() / 1000
+	expiredTombstone := nowMicros - 2*time.Hour.Microseconds()
+	freshTombstone := nowMicros
+
+	in := writeTestSst(t, dir, "in", []testMergeRow{
+		{"expired", expiredTombstone, nil},
+		{"fresh", freshTombstone, nil},
+		{"live", nowMicros, []byte("v")},
+	})
+
+	outs, err := d.mergeSstFiles([]*sstFile{in})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outs) != 1 {
+		t.Fatalf("got %d output files, want 1", len(outs))
+	}
+
+	got := readAllRows(t, outs[0])
+	if len(got) != 2 {
+		t.Fatalf("got %d rows, want 2 (expired tombstone dropped): %+v", len(got), got)
+	}
+	for _, r := range got {
+		if r.key == "expired" {
+			t.Errorf("expired tombstone survived compaction: %+v", r)
+		}
+	}
+}
+
+func TestMergeSstFilesSplitsOnTargetFileSize(t *testing.T) {
+	opts := DefaultOptions("")
+	opts.CompactionTargetFileSizeBytes = 512
+	d, dir := testMergeDatabase(t, opts)
+
+	value := make([]byte, 64)
+	var rows []testMergeRow
+	for i := 0; i < 50; i++ {
+		rows = append(rows, testMergeRow{key: fmt.Sprintf("key%03d", i), ts: int64(i + 1), value: value})
+	}
+	in := writeTestSst(t, dir, "in", rows)
+
+	outs, err := d.mergeSstFiles([]*sstFile{in})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outs) < 2 {
+		t.Fatalf("got %d output file(s), want at least 2 given a %d byte cap", len(outs), opts.CompactionTargetFileSizeBytes)
+	}
+
+	var gotKeys []string
+	for _, out := range outs {
+		if out.r.SizeBytes() <= 0 {
+			t.Errorf("output file %v has non-positive size", out.r.Filename())
+		}
+		for _, r := range readAllRows(t, out) {
+			gotKeys = append(gotKeys, r.key)
+		}
+	}
+	if len(gotKeys) != len(rows) {
+		t.Fatalf("got %d rows across outputs, want %d", len(gotKeys), len(rows))
+	}
+	for i, r := range rows {
+		if gotKeys[i] != r.key {
+			t.Errorf("row %d = %v, want %v (outputs not in key order)", i, gotKeys[i], r.key)
+		}
+	}
+}
@@ -23,8 +23,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/danchia/ddb/flowcontrol"
 	"github.com/danchia/ddb/memtable"
 	pb "github.com/danchia/ddb/proto"
+	"github.com/danchia/ddb/ratelimit"
 	"github.com/danchia/ddb/sst"
 	"github.com/danchia/ddb/wal"
 	"github.com/golang/glog"
@@ -43,15 +45,103 @@ type database struct {
 	logWriter *wal.Writer
 
 	blockCache *sst.Cache
-	ssts       []*sst.Reader
+
+	// levels holds this database's SSTs, bucketed by compaction level.
+	// levels[0] is L0: flushed straight from memtables, size-tiered, and its
+	// files may overlap each other's key ranges. levels[n] for n>=1 are
+	// size-tiered by opts.LevelSizeMultiplier, and each level's files are
+	// disjoint and sorted by minKey, so at most one file per level can
+	// contain any given key. See sstFile for why level isn't persisted.
+	levels [][]*sstFile
+
+	// compactPtr[n] is the maxKey of the file compactLevel last picked from
+	// level n, for levels n>=1. The picker rotates through each level's
+	// keyspace a file at a time so compaction work doesn't repeatedly
+	// hammer the same key range.
+	compactPtr []string
+
+	// compactionLimiter throttles the bandwidth used by background
+	// compaction, per opts.CompactionBandwidthBytesPerSec.
+	compactionLimiter ratelimit.Limiter
+
+	// flushLimiter throttles the bandwidth used by flushIMemtable, per
+	// opts.FlushBytesPerSec, independently of compactionLimiter.
+	flushLimiter ratelimit.Limiter
+
+	// writeLimiter rejects Set calls once logWriter's observed append
+	// throughput has sustained above opts.MaxWriteBytesPerSec.
+	writeLimiter *flowcontrol.Limiter
+
+	// imemtableSince is when the current imemtable (if any) was frozen,
+	// i.e. when it stopped accepting writes and started waiting for
+	// flushIMemtable. Used by maybeStallWrite to detect a flush that's
+	// taking too long. Zero if imemtable is nil.
+	imemtableSince time.Time
+
+	// compactionCond is signalled by flushIMemtable, compactL0 and
+	// compactLevel whenever they change d.levels or d.imemtable, so a
+	// writer blocked in maybeStallWrite's hard stall can recheck whether it
+	// should keep waiting.
+	compactionCond *sync.Cond
+
+	// stallMu guards writeStallCount, writeStallDuration and
+	// lastStallWarnAt, tracking how much maybeStallWrite has throttled
+	// writes.
+	stallMu            sync.Mutex
+	writeStallCount    int64
+	writeStallDuration time.Duration
+	lastStallWarnAt    time.Time
 
 	mu sync.RWMutex
 }
 
+// WriteStallStats is a snapshot of how much Set/Write have been delayed or
+// blocked by maybeStallWrite, so operators can tell when compaction can't
+// keep up with the write rate.
+type WriteStallStats struct {
+	Count    int64
+	Duration time.Duration
+}
+
+// WALAdmissionStats is a snapshot of the WAL writer's admission-control
+// state (see Options.WalMaxInFlightBytes), so operators can tell a healthy
+// fsync loop from one that's shedding load.
+type WALAdmissionStats struct {
+	InFlightBytes   int64
+	InFlightRecords int64
+	Stalls          int64
+}
+
+// WALAdmissionStats returns d's current WAL admission-control snapshot.
+func (d *database) WALAdmissionStats() WALAdmissionStats {
+	return WALAdmissionStats{
+		InFlightBytes:   d.logWriter.InFlightBytes(),
+		InFlightRecords: d.logWriter.InFlightRecords(),
+		Stalls:          d.logWriter.Stalls(),
+	}
+}
+
+// writeLimiterSustainWindow is how long WAL append throughput must stay
+// above MaxWriteBytesPerSec before Set starts rejecting new writes. A short
+// burst shouldn't trip the limiter; a sustained one should.
+const writeLimiterSustainWindow = 2 * time.Second
+
 func newDatabase(opts Options) *database {
+	compactionLimiter := ratelimit.Nop()
+	if opts.CompactionBandwidthBytesPerSec > 0 {
+		compactionLimiter = ratelimit.New(opts.CompactionBandwidthBytesPerSec)
+	}
+	flushLimiter := ratelimit.Nop()
+	if opts.FlushBytesPerSec > 0 {
+		flushLimiter = ratelimit.New(opts.FlushBytesPerSec)
+	}
+
 	db := &database{
-		opts: opts,
+		opts:              opts,
+		compactionLimiter: compactionLimiter,
+		flushLimiter:      flushLimiter,
 	}
+	db.compactionCond = sync.NewCond(&db.mu)
 
 	ensureDir(opts.DescriptorDir)
 	ensureDir(opts.LogDir)
@@ -72,6 +162,8 @@ func newDatabase(opts Options) *database {
 		db.blockCache = sst.NewCache(opts.BlockCacheSize)
 	}
 
+	db.ensureLevelLocked(0)
+
 	lastAppliedSeqNo := int64(0)
 	for _, sstMeta := range descriptor.Current.SstMeta {
 		if sstMeta.AppliedUntil > lastAppliedSeqNo {
@@ -81,7 +173,13 @@ func newDatabase(opts Options) *database {
 		if err != nil {
 			glog.Fatalf("Error while opening SST: %v", err)
 		}
-		db.ssts = append(db.ssts, sstReader)
+		minKey, maxKey, err := sstReader.KeyRange()
+		if err != nil {
+			glog.Fatalf("Error while reading key range of SST: %v", err)
+		}
+		// Every SST is re-assigned to L0 on restart: level isn't persisted
+		// (see sstFile). The compactor naturally re-levels them from here.
+		db.levels[0] = append(db.levels[0], &sstFile{r: sstReader, minKey: minKey, maxKey: maxKey, appliedUntil: sstMeta.AppliedUntil})
 	}
 
 	db.memtable = memtable.New(lastAppliedSeqNo)
@@ -91,12 +189,22 @@ func newDatabase(opts Options) *database {
 		glog.Fatalf("Failed to recover log file: %v", err)
 	}
 
-	logOpts := wal.Options{Dirname: opts.LogDir, TargetSize: opts.TargetLogSize}
+	logOpts := wal.Options{
+		Dirname:    opts.LogDir,
+		TargetSize: opts.TargetLogSize,
+
+		MaxBatchDelay:   opts.WalMaxBatchDelay,
+		MaxBatchBytes:   opts.WalMaxBatchBytes,
+		MaxBatchRecords: opts.WalMaxBatchRecords,
+
+		MaxInFlightBytes: opts.WalMaxInFlightBytes,
+	}
 	logWriter, err := wal.NewWriter(nextSeq, logOpts)
 	if err != nil {
 		glog.Fatalf("Error creating WAL writer: %v", err)
 	}
 	db.logWriter = logWriter
+	db.writeLimiter = flowcontrol.NewLimiter(logWriter.Monitor(), float64(opts.MaxWriteBytesPerSec), writeLimiterSustainWindow)
 
 	go db.compactor()
 
@@ -104,7 +212,7 @@ func newDatabase(opts Options) *database {
 }
 
 func (d *database) recoverLog(lastApplied int64) (nextSeq int64, err error) {
-	sc, err := wal.NewScanner(d.opts.LogDir)
+	r, err := wal.NewReader(d.opts.LogDir)
 	if os.IsNotExist(err) {
 		glog.Infof("no log files found")
 		return 0, nil
@@ -113,40 +221,40 @@ func (d *database) recoverLog(lastApplied int64) (nextSeq int64, err error) {
 		return 0, err
 	}
 
-	n := int64(0)
 	applied := int64(0)
 	seqNo := lastApplied
 
-	for sc.Scan() {
-		r := sc.Record()
-		n++
-
+	replayErr := r.ReplayFrom(lastApplied, func(l *pb.LogRecord) error {
 		if glog.V(4) {
-			glog.V(4).Infof("Read wal record: %v", r)
+			glog.V(4).Infof("Read wal record: %v", l)
 		}
 
-		if r.Sequence <= seqNo {
-			// we've already seen this, skip
-			continue
-		}
 		applied++
-
-		seqNo = r.Sequence
-		if r.Mutation == nil {
-			continue
+		seqNo = l.Sequence
+		if l.Mutation != nil || len(l.Mutations) > 0 {
+			d.apply(l)
 		}
-		d.apply(r)
+		return nil
+	})
+	if replayErr != nil {
+		return 0, replayErr
+	}
+	// A torn tail record from a crash mid-Append is expected and already
+	// handled by ReplayFrom above; Repair drops it so the log is clean for
+	// new Appends. It's a no-op if the log ended cleanly.
+	if err := r.Repair(); err != nil {
+		return 0, err
 	}
-	d.maybeTriggerFlush()
 
-	glog.Infof("Scanned %d log entries, applied %d", n, applied)
+	glog.Infof("Applied %d log entries", applied)
+	d.maybeTriggerFlush()
 
 	if seqNo == -1 {
 		// TODO: it's possible that if we truncate the log and don't have any new mutations
 		// we won't get a sequence number, even if we can recover it from the file metadata.
 		glog.Fatalf("seqNo was not recovered")
 	}
-	return seqNo, sc.Err()
+	return seqNo, nil
 }
 
 func ensureDir(dir string) {
@@ -162,6 +270,12 @@ func (d *database) Set(ctx context.Context, req *pb.SetRequest) (*pb.SetResponse
 	if err := validateValue(req.Value); err != nil {
 		return nil, err
 	}
+	if err := d.writeLimiter.Admit(); err != nil {
+		return nil, err
+	}
+	recordWriteThroughput(ctx, d.logWriter.Stats().BytesPerSecEMA)
+	recordGroupCommitStats(ctx, d.logWriter.GroupCommitStats())
+	d.maybeStallWrite()
 
 	// TODO: this needs to be monotonically increasing. hybrid logical clocks?
 	ts := time.Now().UnixNano() / 1000
@@ -195,18 +309,92 @@ func (d *database) Set(ctx context.Context, req *pb.SetRequest) (*pb.SetResponse
 
 	err := <-ch
 	if err != nil {
-		return nil, err
+		return nil, mapWALErr(err)
 	}
 	return &pb.SetResponse{Timestamp: ts}, nil
 }
 
+// mapWALErr translates the sentinel wal.ErrWALOverloaded into a
+// codes.ResourceExhausted status, so clients can tell "retry with backoff"
+// apart from other failures. (d.writeLimiter.Admit's EMA-based throughput
+// ceiling rejects with codes.Unavailable instead.)
+func mapWALErr(err error) error {
+	if err == wal.ErrWALOverloaded {
+		return status.Errorf(codes.ResourceExhausted, "%v", err)
+	}
+	return err
+}
+
+// Write commits every mutation staged in b atomically: they're marshalled
+// into a single pb.LogRecord, appended to the WAL as one record under one
+// sequence number, and applied to the memtable under a single d.mu
+// acquisition, so a reader can never observe some but not all of the
+// batch. Because the whole batch is one WAL record, it's also atomic
+// across a crash: ReplayFrom only ever hands recoverLog a record that
+// passed its checksum whole, so a crash mid-Append yields a torn tail
+// (dropped by Repair, same as a torn single-mutation record) rather than
+// a partially-applied batch. Returns the timestamp assigned to the batch.
+func (d *database) Write(ctx context.Context, b *WriteBatch) (int64, error) {
+	if len(b.mutations) == 0 {
+		return 0, nil
+	}
+	if err := d.writeLimiter.Admit(); err != nil {
+		return 0, err
+	}
+	recordWriteThroughput(ctx, d.logWriter.Stats().BytesPerSecEMA)
+	recordGroupCommitStats(ctx, d.logWriter.GroupCommitStats())
+	d.maybeStallWrite()
+
+	// TODO: this needs to be monotonically increasing. hybrid logical clocks?
+	ts := time.Now().UnixNano() / 1000
+	for _, m := range b.mutations {
+		m.Timestamp = ts
+	}
+
+	l := &pb.LogRecord{Mutations: b.mutations}
+
+	ch := make(chan error, 1)
+	trace.FromContext(ctx).Annotate(nil, "appending batch to log")
+	d.logWriter.Append(l, func(err error) {
+		trace.FromContext(ctx).Annotate(nil, "appending batch log done")
+		ch <- err
+	})
+
+	if err := <-ch; err != nil {
+		return 0, mapWALErr(err)
+	}
+
+	d.mu.Lock()
+	d.apply(l)
+	d.maybeTriggerFlush()
+	d.mu.Unlock()
+
+	return ts, nil
+}
+
+// Stats returns the database's observed WAL append throughput.
+func (d *database) Stats() flowcontrol.Status {
+	return d.logWriter.Stats()
+}
+
+// apply inserts every mutation l carries into the memtable, all under l's
+// sequence number: a single-mutation Set record has one, a WriteBatch
+// record (see Write) has several, all logically simultaneous.
 func (d *database) apply(l *pb.LogRecord) {
-	m := l.Mutation
+	if l.Mutation != nil {
+		d.applyMutation(l.Sequence, l.Mutation)
+	}
+	for _, m := range l.Mutations {
+		d.applyMutation(l.Sequence, m)
+	}
+}
+
+func (d *database) applyMutation(seq int64, m *pb.Mutation) {
 	switch m.Type {
 	case pb.Mutation_PUT:
-		d.memtable.Insert(l.Sequence, m.Key, m.Timestamp, m.Value)
+		d.memtable.Insert(seq, m.Key, m.Timestamp, m.Value)
 	case pb.Mutation_DELETE:
-		d.memtable.Insert(l.Sequence, m.Key, m.Timestamp, nil)
+		d.memtable.Insert(seq, m.Key, m.Timestamp, nil)
 	default:
 		glog.Fatalf("Mutation with unrecognized type: %v", m)
 	}
@@ -219,18 +407,35 @@ func (d *database) maybeTriggerFlush() {
 	}
 }
 
-func (d *database) Find(ctx context.Context, key string) ([]byte, error) {
+// Find returns the value of key, or nil if not present. If snap is non-nil,
+// the read is as of snap instead of the latest state (see Snapshot).
+func (d *database) Find(ctx context.Context, key string, snap *Snapshot) ([]byte, error) {
+	if snap != nil {
+		return d.findAsOf(ctx, key, snap)
+	}
+
 	// Acquire local copies of required structures, so that we can release lock quickly.
 	d.mu.RLock()
 
-	ssts := make([]*sst.Reader, len(d.ssts))
-	for i, sst := range d.ssts {
-		sst.Ref()
-		ssts[i] = sst
+	// L0 files can overlap, so every one of them might hold key. Levels n>=1
+	// are disjoint, so at most one file per level can.
+	var candidates []*sst.Reader
+	for _, f := range d.levels[0] {
+		f.r.Ref()
+		candidates = append(candidates, f.r)
+	}
+	for n := 1; n < len(d.levels); n++ {
+		for _, f := range d.levels[n] {
+			if f.containsKey(key) {
+				f.r.Ref()
+				candidates = append(candidates, f.r)
+				break
+			}
+		}
 	}
 	defer func() {
-		for _, sst := range ssts {
-			sst.UnRef()
+		for _, r := range candidates {
+			r.UnRef()
 		}
 	}()
 
@@ -252,7 +457,7 @@ func (d *database) Find(ctx context.Context, key string) ([]byte, error) {
 	var value []byte
 	valueTs := int64(math.MinInt64)
 
-	for _, s := range ssts {
+	for _, s := range candidates {
 		v, ts, err := s.Find(ctx, key)
 		if err == sst.ErrNotFound {
 			continue
@@ -269,9 +474,55 @@ func (d *database) Find(ctx context.Context, key string) ([]byte, error) {
 	return value, nil
 }
 
+// findAsOf implements Find for a non-nil snapshot: only entries with
+// sequence <= snap.seq are visible, so writes after the snapshot was taken
+// don't show up in it.
+//
+// snap.ssts don't need their own sequence check here: they're exactly the
+// SSTs that existed when the snapshot was taken, and an SST is only ever
+// written once, from a memtable frozen at flush time, so every row already
+// in one of them has sequence <= snap.seq. Only the memtables need
+// filtering, since the active one keeps accepting writes after the
+// snapshot is taken.
+func (d *database) findAsOf(ctx context.Context, key string, snap *Snapshot) ([]byte, error) {
+	v, found := snap.memtable.FindAsOf(key, snap.seq)
+	if found {
+		return v, nil
+	}
+	if snap.imemtable != nil {
+		v, found = snap.imemtable.FindAsOf(key, snap.seq)
+		if found {
+			return v, nil
+		}
+	}
+
+	var value []byte
+	valueTs := int64(math.MinInt64)
+
+	for _, f := range snap.ssts {
+		if !f.containsKey(key) {
+			continue
+		}
+		v, ts, err := f.r.Find(ctx, key)
+		if err == sst.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ts > valueTs {
+			value = v
+			valueTs = ts
+		}
+	}
+
+	return value, nil
+}
+
 func (d *database) swapMemtableLocked() {
 	m := d.memtable
 	d.imemtable = m
+	d.imemtableSince = time.Now()
 	d.memtable = memtable.New(m.SequenceUpper())
 }
 
@@ -287,7 +538,10 @@ func (d *database) flushIMemtable() {
 
 	glog.Infof("flushing memtable of size %v to %v", m.SizeBytes(), fullFn)
 
-	writer, err := sst.NewWriter(fullFn)
+	writerOpts := sst.DefaultWriterOptions()
+	writerOpts.Limiter = d.flushLimiter
+	writerOpts.TargetFPRate = d.opts.BloomTargetFPRate
+	writer, err := sst.NewWriterOptions(fullFn, writerOpts)
 	if err != nil {
 		glog.Fatalf("error opening SST while flushing memtable: %v", err)
 	}
@@ -319,128 +573,24 @@ func (d *database) flushIMemtable() {
 		glog.Fatalf("error saving descriptor while flushing memtable: %v", err)
 	}
 	d.imemtable = nil
-	d.ssts = append(d.ssts, reader)
+	d.imemtableSince = time.Time{}
+	d.levels[0] = append(d.levels[0], &sstFile{r: reader, minKey: writer.FirstKey(), maxKey: writer.LastKey(), appliedUntil: m.SequenceUpper()})
+	d.compactionCond.Broadcast()
 	d.mu.Unlock()
 }
 
 //func (d *database) cleanUnusedFiles() {
 //}
 
-// compactor monitors the number of SSTs, and triggers compaction when necessary.
-// Currently the scheme is a very simple one - if there are more than 8 SSTs then compaction
-// of all the SSTs is triggered.
+// compactor periodically checks whether L0 or any Ln is over its
+// compaction trigger/target size, and runs at most one compaction job per
+// tick so compactions don't pile up concurrently. See maybeCompact and the
+// rest of compaction.go for the leveled scheme itself.
 func (d *database) compactor() {
 	ticker := time.NewTicker(1 * time.Second)
 	for range ticker.C {
-		var toCompact []*sst.Reader
-		d.mu.RLock()
-		if len(d.ssts) > 8 {
-			toCompact = d.ssts
-		}
-		d.mu.RUnlock()
-
-		if len(toCompact) > 0 {
-			d.compact(toCompact)
-		}
-	}
-}
-
-// compact compacts ssts into a single SST and modifies the descriptor as appropriate.
-func (d *database) compact(ssts []*sst.Reader) {
-	ts := time.Now().UnixNano()
-	fn := fmt.Sprintf("%020d.sst", ts)
-	fullFn := filepath.Join(d.opts.SstDir, fn)
-
-	glog.Infof("Compacting %v SSTs to %v", len(ssts), fullFn)
-	if glog.V(4) {
-		var names []string
-		for _, sst := range ssts {
-			names = append(names, sst.Filename())
-		}
-		glog.Infof("SSTs being compacted are %v", names)
-	}
-
-	iters := make([]Iter, len(ssts))
-	for i, sst := range ssts {
-		iter, err := sst.NewIter()
-		if err != nil {
-			glog.Fatalf("Error creating SST iter for compaction: %v", err)
-		}
-		iters[i] = iter
-	}
-
-	mIter, err := newMergingIter(iters)
-	if err != nil {
-		glog.Fatalf("Error creating merge iter: %v", err)
-	}
-
-	writer, err := sst.NewWriter(fullFn)
-	if err != nil {
-		glog.Fatalf("Error opening SST for writing: %v", err)
+		d.maybeCompact()
 	}
-
-	for {
-		hasNext, err := mIter.Next()
-		if err != nil {
-			glog.Fatalf("Error writing to SST during compaction: %v", err)
-		}
-		if !hasNext {
-			break
-		}
-
-		writer.Append(mIter.Key(), mIter.Timestamp(), mIter.Value())
-	}
-
-	mIter.Close()
-
-	if err := writer.Close(); err != nil {
-		glog.Fatalf("Error closing writer while compacting: %v", err)
-	}
-
-	glog.Infof("Compaction finished for %v", fullFn)
-
-	filenames := make(map[string]bool)
-	for _, sst := range ssts {
-		filenames[sst.Filename()] = true
-	}
-
-	reader, err := sst.NewReader(fullFn, d.blockCache)
-	if err != nil {
-		glog.Fatalf("error opening freshly compacted SST %v: %v", fullFn, err)
-	}
-
-	d.mu.Lock()
-	var newMetas []*pb.SstMeta
-	maxApplied := int64(0)
-	for _, meta := range d.descriptor.Current.SstMeta {
-		if filenames[filepath.Join(d.opts.SstDir, meta.Filename)] {
-			if meta.AppliedUntil > maxApplied {
-				maxApplied = meta.AppliedUntil
-			}
-			continue
-		}
-		newMetas = append(newMetas, meta)
-	}
-	newMeta := &pb.SstMeta{Filename: fn, AppliedUntil: maxApplied}
-	newMetas = append(newMetas, newMeta)
-	d.descriptor.Current.SstMeta = newMetas
-	if err := d.descriptor.Save(); err != nil {
-		glog.Fatalf("error saving descriptor while flushing memtable: %v", err)
-	}
-
-	glog.V(4).Infof("Descriptor after compaction is: %v", d.descriptor)
-
-	var newSsts []*sst.Reader
-	for _, sst := range d.ssts {
-		if filenames[sst.Filename()] {
-			sst.UnRef()
-			continue
-		}
-		newSsts = append(newSsts, sst)
-	}
-	newSsts = append(newSsts, reader)
-	d.ssts = newSsts
-	d.mu.Unlock()
 }
 
 func validateKey(k string) error {
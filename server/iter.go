@@ -1,9 +1,26 @@
 package server
 
-// Iter is an iterator over rows.
+import "strings"
+
+// Iter is an iterator over rows, implemented consistently by sst.Iter,
+// memtable.Iterator, and mergingIter, so any of them can be used
+// interchangeably as a merge input or returned from a range scan.
 type Iter interface {
+	// SeekGE positions the iterator at the first row with key >= the given
+	// key. Returns whether such a row exists.
+	SeekGE(key string) bool
+
+	// SeekPrefix positions the iterator at the first row whose key has the
+	// given prefix. Returns whether such a row exists. Does not bound
+	// subsequent Next calls to the prefix; callers should check Key()
+	// themselves.
+	SeekPrefix(prefix string) bool
+
 	// Next advances the iterator. Returns true if there is a next value.
-	Next() (bool, error)
+	Next() bool
+
+	// Valid returns whether the iterator is currently positioned at a row.
+	Valid() bool
 
 	// Key returns the key of the current row.
 	Key() string
@@ -13,6 +30,12 @@ type Iter interface {
 
 	// Value returns the value of the current row.
 	Value() []byte
+
+	// Err returns the first error encountered during iteration, if any.
+	Err() error
+
+	// Close closes the iterator, releasing any associated resources.
+	Close() error
 }
 
 type KTV struct {
@@ -21,23 +44,53 @@ type KTV struct {
 	Value     []byte
 }
 
+// memIter is an Iter over an in-memory, pre-sorted slice of rows. Used in
+// tests in place of a real sst.Iter or memtable.Iterator.
 type memIter struct {
 	rows  []KTV
 	index int
 }
 
-// NewIterFromRows returns an Iter represents rows. rows must not be modified after.
+// NewIterFromRows returns an Iter represents rows. rows must be sorted in
+// (key asc, timestamp desc) order, and must not be modified after.
 func NewIterFromRows(rows []KTV) Iter {
 	return &memIter{rows: rows, index: -1}
 }
 
-func (i *memIter) Next() (bool, error) {
+func (i *memIter) SeekGE(key string) bool {
+	i.index = len(i.rows)
+	for idx, r := range i.rows {
+		if r.Key >= key {
+			i.index = idx
+			break
+		}
+	}
+	return i.Valid()
+}
+
+func (i *memIter) SeekPrefix(prefix string) bool {
+	if !i.SeekGE(prefix) {
+		return false
+	}
+	if !strings.HasPrefix(i.Key(), prefix) {
+		i.index = len(i.rows)
+		return false
+	}
+	return true
+}
+
+func (i *memIter) Next() bool {
 	if i.index+1 >= len(i.rows) {
-		return false, nil
+		i.index = len(i.rows)
+		return false
 	}
 
 	i.index++
-	return true, nil
+	return true
+}
+
+func (i *memIter) Valid() bool {
+	return i.index >= 0 && i.index < len(i.rows)
 }
 
 func (i *memIter) Key() string {
@@ -51,3 +104,7 @@ func (i *memIter) Timestamp() int64 {
 func (i *memIter) Value() []byte {
 	return i.rows[i.index].Value
 }
+
+func (i *memIter) Err() error { return nil }
+
+func (i *memIter) Close() error { return nil }
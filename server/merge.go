@@ -18,13 +18,16 @@ import (
 	"container/heap"
 )
 
-// mergingIter is an iterator that merges from many Iter.
+// mergingIter is an Iter that merges the output of many Iter, in (key asc,
+// timestamp desc) order.
 type mergingIter struct {
 	h *iterHeap
 
 	curKey   string
 	curTs    int64
 	curValue []byte
+	valid    bool
+	err      error
 
 	iters []Iter
 }
@@ -35,43 +38,83 @@ func newMergingIter(iters []Iter) (*mergingIter, error) {
 		iters: iters,
 	}
 
+	// An input may start before its first row (e.g. sst.Reader.NewIter) or
+	// already positioned at it (e.g. a NewRangeIterator).
 	for _, iter := range iters {
-		hasNext, err := iter.Next()
-		if err != nil {
-			mi.Close()
-			return nil, err
-		}
-		if hasNext {
+		if iter.Valid() || iter.Next() {
 			*mi.h = append(*mi.h, iter)
+		} else if iter.Err() != nil {
+			mi.Close()
+			return nil, iter.Err()
 		}
 	}
 	heap.Init(mi.h)
 	return mi, nil
 }
 
+// SeekGE positions the iterator at the first row with key >= the given key,
+// by seeking every sub-iterator and rebuilding the heap. Returns whether such
+// a row exists.
+func (i *mergingIter) SeekGE(key string) bool {
+	*i.h = (*i.h)[:0]
+	for _, iter := range i.iters {
+		if iter.SeekGE(key) {
+			*i.h = append(*i.h, iter)
+		} else if iter.Err() != nil {
+			i.err = iter.Err()
+		}
+	}
+	heap.Init(i.h)
+	return i.advance()
+}
+
+// SeekPrefix positions the iterator at the first row whose key has the given
+// prefix. Returns whether such a row exists. Does not bound subsequent Next
+// calls to the prefix; callers should check Key() themselves.
+func (i *mergingIter) SeekPrefix(prefix string) bool {
+	*i.h = (*i.h)[:0]
+	for _, iter := range i.iters {
+		if iter.SeekPrefix(prefix) {
+			*i.h = append(*i.h, iter)
+		} else if iter.Err() != nil {
+			i.err = iter.Err()
+		}
+	}
+	heap.Init(i.h)
+	return i.advance()
+}
+
 // Next advances the iterator. Returns true if there is a next value.
-func (i *mergingIter) Next() (bool, error) {
+func (i *mergingIter) Next() bool {
+	return i.advance()
+}
+
+// advance pops the least iterator off the heap, makes it the current row,
+// and pushes it back if it has more rows.
+func (i *mergingIter) advance() bool {
 	if i.h.Len() == 0 {
-		return false, nil
+		i.valid = false
+		return false
 	}
 
 	iter := heap.Pop(i.h).(Iter)
 	i.curKey = iter.Key()
 	i.curTs = iter.Timestamp()
 	i.curValue = iter.Value()
+	i.valid = true
 
-	hasNext, err := iter.Next()
-	if err != nil {
-		return false, err
-	}
-
-	if hasNext {
+	if iter.Next() {
 		heap.Push(i.h, iter)
+	} else if iter.Err() != nil {
+		i.err = iter.Err()
 	}
 
-	return true, nil
+	return true
 }
 
+// Valid returns whether the iterator is positioned at a row.
+func (i *mergingIter) Valid() bool { return i.valid }
+
 // Key returns the current key.
 func (i *mergingIter) Key() string { return i.curKey }
 
@@ -81,11 +124,19 @@ func (i *mergingIter) Timestamp() int64 { return i.curTs }
 // Value returns the current value.
 func (i *mergingIter) Value() []byte { return i.curValue }
 
-// Close closes the iterator by closing all the underlying iters.
-func (i *mergingIter) Close() {
+// Err returns the first error encountered by any underlying iterator, if any.
+func (i *mergingIter) Err() error { return i.err }
+
+// Close closes the iterator by closing all the underlying iters, returning
+// the first error encountered, if any.
+func (i *mergingIter) Close() error {
+	var first error
 	for _, it := range i.iters {
-		it.Close()
+		if err := it.Close(); err != nil && first == nil {
+			first = err
+		}
 	}
+	return first
 }
 
 type iterHeap []Iter
@@ -14,8 +14,11 @@ func TestMergeEmpty(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if hasNext, err := merging.Next(); hasNext != false || err != nil {
-		t.Errorf("Next() = (%v, %v), want (false, nil)", hasNext, err)
+	if hasNext := merging.Next(); hasNext != false {
+		t.Errorf("Next() = %v, want false", hasNext)
+	}
+	if err := merging.Err(); err != nil {
+		t.Errorf("Err() = %v, want nil", err)
 	}
 }
 
@@ -36,20 +39,15 @@ func TestMerge(t *testing.T) {
 
 	var got []KTV
 
-	for {
-		hasNext, err := merging.Next()
-		if err != nil {
-			t.Fatal(err)
-		}
-		if !hasNext {
-			break
-		}
-
+	for merging.Next() {
 		row := KTV{merging.Key(), merging.Timestamp(), merging.Value()}
 		got = append(got, row)
 
 		glog.V(4).Infof("got: %v", row)
 	}
+	if err := merging.Err(); err != nil {
+		t.Fatal(err)
+	}
 
 	expected := []KTV{
 		{"abc", 0, []byte("1")},
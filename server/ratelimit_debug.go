@@ -0,0 +1,58 @@
+package server
+
+import (
+	"html/template"
+	"net/http"
+	"sync"
+
+	"github.com/danchia/ddb/ratelimit"
+)
+
+// RateLimits handles debug requests for the per-client write rate limiter
+// state (see Options.PerClientWriteLimits). Registered alongside Traces.
+func (s *Server) RateLimits(w http.ResponseWriter, req *http.Request) {
+	if !isAllowed(req) {
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	data := &rateLimitDisplay{Clients: s.WriteRateLimiterStats()}
+	if err := rateLimitTmpl().ExecuteTemplate(w, "ratelimit", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+type rateLimitDisplay struct {
+	Clients []ratelimit.ClientStats
+}
+
+var rateLimitTmplCache *template.Template
+var rateLimitTemplateOnce sync.Once
+
+func rateLimitTmpl() *template.Template {
+	rateLimitTemplateOnce.Do(func() {
+		rateLimitTmplCache = template.Must(template.New("ratelimit").Parse(rateLimitHTML))
+	})
+	return rateLimitTmplCache
+}
+
+const rateLimitHTML = `
+<html>
+	<head><title>ddebug/ratelimit</title></head>
+	<body>
+		<table border="1">
+			<tr><th>Client</th><th>Bytes/sec</th><th>Utilization</th><th>Ops/sec</th></tr>
+			{{ range .Clients }}
+			<tr>
+				<td>{{ .Key }}</td>
+				<td>{{ printf "%.0f" .BytesPerSec }}</td>
+				<td>{{ printf "%.2f" .BytesUtilization }}</td>
+				<td>{{ printf "%.2f" .OpsPerSec }}</td>
+			</tr>
+			{{ end }}
+		</table>
+	</body>
+</html>
+`
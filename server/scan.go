@@ -0,0 +1,284 @@
+//    Copyright 2018 Google Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package server
+
+import (
+	"context"
+
+	"github.com/danchia/ddb/memtable"
+	"github.com/danchia/ddb/sst"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MaxScanResponseBytes caps the total size of keys and values a single Scan
+// call will return, so a wide range can't blow up an unbounded gRPC frame.
+// Callers that need more should page using the last returned key as the next
+// call's start.
+const MaxScanResponseBytes = 4 * 1024 * 1024
+
+// Scan returns up to limit rows with keys in [start, end), in ascending key
+// order, merging the active memtable, any immutable memtable awaiting flush,
+// and all SSTs. Only the newest version of each key as of snapshotTs is
+// returned, and deletion tombstones are skipped. An empty end means
+// unbounded above; limit <= 0 means unbounded (subject to
+// MaxScanResponseBytes). snapshotTs <= 0 means read the latest value of
+// every key.
+func (d *database) Scan(ctx context.Context, start, end string, limit int, snapshotTs int64) ([]KTV, error) {
+	if err := validateScanBound(start); err != nil {
+		return nil, err
+	}
+	if err := validateScanBound(end); err != nil {
+		return nil, err
+	}
+
+	d.mu.RLock()
+	// Skip any file whose key range doesn't intersect [start, end) at all,
+	// across every level.
+	var ssts []*sst.Reader
+	for _, level := range d.levels {
+		for _, f := range level {
+			if f.overlaps(start, end) {
+				f.r.Ref()
+				ssts = append(ssts, f.r)
+			}
+		}
+	}
+	defer func() {
+		for _, s := range ssts {
+			s.UnRef()
+		}
+	}()
+	memtable := d.memtable
+	imemtable := d.imemtable
+	d.mu.RUnlock()
+
+	var iters []Iter
+	iters = append(iters, memtable.NewRangeIterator(start, end))
+	if imemtable != nil {
+		iters = append(iters, imemtable.NewRangeIterator(start, end))
+	}
+	for _, s := range ssts {
+		it, err := s.NewRangeIterator(start, end)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "error creating SST range iterator: %v", err)
+		}
+		iters = append(iters, it)
+	}
+
+	mi, err := newMergingIter(iters)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error creating merge iterator: %v", err)
+	}
+	defer mi.Close()
+
+	si := newScanIter(mi, snapshotTs)
+
+	var rows []KTV
+	respBytes := 0
+	for si.Next() {
+		row := KTV{Key: si.Key(), Timestamp: si.Timestamp(), Value: si.Value()}
+		respBytes += len(row.Key) + len(row.Value)
+		if len(rows) > 0 && respBytes > MaxScanResponseBytes {
+			break
+		}
+		rows = append(rows, row)
+		if limit > 0 && len(rows) >= limit {
+			break
+		}
+	}
+	if err := si.Err(); err != nil {
+		return nil, status.Errorf(codes.Internal, "error scanning: %v", err)
+	}
+
+	return rows, nil
+}
+
+func validateScanBound(k string) error {
+	if uint32(len(k)) > MaxKeySize {
+		return status.Errorf(codes.InvalidArgument, "Key must be <= %d bytes", MaxKeySize)
+	}
+	return nil
+}
+
+// ScanIter is like Scan, but returns a live Iter instead of materializing
+// rows into a slice up front, so a caller that wants to page an unbounded
+// range (e.g. a future streaming Scan RPC) doesn't have to hold it all in
+// memory at once. If snap is non-nil, the scan is as of snap instead of the
+// latest state (see Snapshot); the caller must Close the returned Iter,
+// which releases the Refs this takes on every SST it reads
+// from, so compaction can reclaim them.
+func (d *database) ScanIter(ctx context.Context, start, end string, snap *Snapshot) (Iter, error) {
+	if err := validateScanBound(start); err != nil {
+		return nil, err
+	}
+	if err := validateScanBound(end); err != nil {
+		return nil, err
+	}
+
+	var mt, imt *memtable.Memtable
+	var ssts []*sst.Reader
+	var snapshotTs int64
+
+	if snap != nil {
+		snapshotTs = snap.ts
+		mt = snap.memtable
+		imt = snap.imemtable
+		for _, f := range snap.ssts {
+			if f.overlaps(start, end) {
+				f.r.Ref()
+				ssts = append(ssts, f.r)
+			}
+		}
+	} else {
+		d.mu.RLock()
+		for _, level := range d.levels {
+			for _, f := range level {
+				if f.overlaps(start, end) {
+					f.r.Ref()
+					ssts = append(ssts, f.r)
+				}
+			}
+		}
+		mt = d.memtable
+		imt = d.imemtable
+		d.mu.RUnlock()
+	}
+	unrefAll := func() {
+		for _, r := range ssts {
+			r.UnRef()
+		}
+	}
+
+	var iters []Iter
+	iters = append(iters, mt.NewRangeIterator(start, end))
+	if imt != nil {
+		iters = append(iters, imt.NewRangeIterator(start, end))
+	}
+	for _, r := range ssts {
+		it, err := r.NewRangeIterator(start, end)
+		if err != nil {
+			unrefAll()
+			return nil, status.Errorf(codes.Internal, "error creating SST range iterator: %v", err)
+		}
+		iters = append(iters, it)
+	}
+
+	mi, err := newMergingIter(iters)
+	if err != nil {
+		unrefAll()
+		return nil, status.Errorf(codes.Internal, "error creating merge iterator: %v", err)
+	}
+
+	si := newScanIter(mi, snapshotTs)
+	si.ssts = ssts
+	return si, nil
+}
+
+// scanIter wraps an Iter already merged in (key asc, timestamp desc) order
+// and reduces it to one row per key: the newest version at or before
+// snapshotTs, skipping deletion tombstones (a nil value). snapshotTs <= 0
+// means no bound; the newest version of every key is visible. Implements
+// Iter so it can be returned directly from ScanIter.
+type scanIter struct {
+	inner      Iter
+	snapshotTs int64
+
+	// ssts is non-nil only for a scanIter returned by ScanIter, which Refs
+	// these itself (unlike Scan, which Refs and UnRefs around its own
+	// function body); Close releases them.
+	ssts []*sst.Reader
+
+	lastKey string
+	hasLast bool
+	valid   bool
+	closed  bool
+}
+
+func newScanIter(inner Iter, snapshotTs int64) *scanIter {
+	return &scanIter{inner: inner, snapshotTs: snapshotTs}
+}
+
+// SeekGE positions the iterator at the first visible row with key >= key.
+// Returns whether such a row exists.
+func (s *scanIter) SeekGE(key string) bool {
+	s.hasLast = false
+	if !s.inner.SeekGE(key) {
+		s.valid = false
+		return false
+	}
+	return s.advance(true)
+}
+
+// SeekPrefix positions the iterator at the first visible row whose key has
+// the given prefix. Returns whether such a row exists.
+func (s *scanIter) SeekPrefix(prefix string) bool {
+	s.hasLast = false
+	if !s.inner.SeekPrefix(prefix) {
+		s.valid = false
+		return false
+	}
+	return s.advance(true)
+}
+
+// Next advances to the next key's visible version, skipping tombstones and
+// any version shadowed by one already emitted. Returns false once the
+// underlying iterator is exhausted.
+func (s *scanIter) Next() bool {
+	return s.advance(false)
+}
+
+// advance finds the next visible row, starting from the inner iterator's
+// current position if atCurrent, or advancing it first otherwise.
+func (s *scanIter) advance(atCurrent bool) bool {
+	for atCurrent || s.inner.Next() {
+		atCurrent = false
+		if s.snapshotTs > 0 && s.inner.Timestamp() > s.snapshotTs {
+			continue
+		}
+		if s.hasLast && s.inner.Key() == s.lastKey {
+			continue
+		}
+		s.lastKey = s.inner.Key()
+		s.hasLast = true
+		if s.inner.Value() == nil {
+			continue
+		}
+		s.valid = true
+		return true
+	}
+	s.valid = false
+	return false
+}
+
+func (s *scanIter) Valid() bool      { return s.valid }
+func (s *scanIter) Key() string      { return s.inner.Key() }
+func (s *scanIter) Timestamp() int64 { return s.inner.Timestamp() }
+func (s *scanIter) Value() []byte    { return s.inner.Value() }
+func (s *scanIter) Err() error       { return s.inner.Err() }
+
+// Close closes the underlying merged iterator and releases any SST Refs
+// this scanIter holds (see ScanIter). Safe to call more than once.
+func (s *scanIter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	err := s.inner.Close()
+	for _, r := range s.ssts {
+		r.UnRef()
+	}
+	return err
+}
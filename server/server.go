@@ -16,13 +16,39 @@ package server
 
 import (
 	"context"
+	"net"
 	"path/filepath"
+	"sync"
+	"time"
 
+	"github.com/danchia/ddb/flowcontrol"
 	pb "github.com/danchia/ddb/proto"
+	"github.com/danchia/ddb/ratelimit"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
+// peerKey returns a stable identifier for the RPC's calling peer, for use
+// as a ratelimit.PerClientLimiter key. It's the peer's IP only, not
+// IP:port: the port is ephemeral and changes on every reconnect, which
+// would otherwise let a client reset its rate limit history (or grow the
+// client map without bound) just by reconnecting. Falls back to "unknown"
+// when ctx carries no peer.Peer, e.g. in unit tests that call Server
+// methods directly rather than through a real gRPC listener, or when the
+// address isn't a host:port (e.g. a Unix socket).
+func peerKey(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "unknown"
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
 const (
 	MaxKeySize   uint32 = 4 * 1024
 	MaxValueSize uint32 = 512 * 1024
@@ -31,6 +57,15 @@ const (
 type Server struct {
 	opts Options
 	db   *database
+
+	// writeRateLimiter throttles Set/Write calls per calling peer (see
+	// Options.PerClientWriteLimits).
+	writeRateLimiter *ratelimit.PerClientLimiter
+
+	// snapshotsMu guards snapshots and nextSnapshotID.
+	snapshotsMu    sync.Mutex
+	snapshots      map[string]*Snapshot
+	nextSnapshotID uint64
 }
 
 type Options struct {
@@ -40,7 +75,103 @@ type Options struct {
 	LogDir        string
 	TargetLogSize int64
 
+	// WalMaxBatchDelay bounds how long the WAL writer holds a batch of
+	// Append calls open, once at least one is queued, hoping more join it
+	// before the next fsync (see wal.Options.MaxBatchDelay). 0 disables this
+	// group-commit wait: only Append calls that already raced in together
+	// get batched.
+	WalMaxBatchDelay time.Duration
+
+	// WalMaxBatchBytes and WalMaxBatchRecords close a WAL batch early, before
+	// WalMaxBatchDelay elapses, once the batch reaches this many bytes or
+	// records respectively (see wal.Options). 0 means unlimited.
+	WalMaxBatchBytes   int
+	WalMaxBatchRecords int
+
+	// WalMaxInFlightBytes rejects Set/Write calls with codes.ResourceExhausted
+	// once the WAL writer already has this many record bytes between Append
+	// and completion (see wal.Options.MaxInFlightBytes), so a backed-up
+	// fsync loop sheds load instead of blocking every caller on a full
+	// recordCh. 0 means unlimited.
+	WalMaxInFlightBytes int64
+
 	DescriptorDir string
+
+	// CompactionBandwidthBytesPerSec throttles the rate at which compaction
+	// writes merged SSTs, so background I/O doesn't starve foreground
+	// reads/writes. 0 means unlimited.
+	CompactionBandwidthBytesPerSec int64
+
+	// FlushBytesPerSec throttles the rate at which flushIMemtable writes a
+	// freshly flushed memtable's SST, independently of
+	// CompactionBandwidthBytesPerSec: flushes are on the critical path for
+	// draining the imemtable (see Options.ImemtableStallThreshold), so
+	// operators may want to cap them separately from, and usually more
+	// generously than, background compaction. 0 means unlimited.
+	FlushBytesPerSec int64
+
+	// MaxWriteBytesPerSec rejects Set calls with codes.Unavailable once
+	// observed WAL append throughput has sustained above this ceiling, so a
+	// runaway client can't swamp the fsync path. 0 means unlimited.
+	MaxWriteBytesPerSec int64
+
+	// L0CompactionFileCount triggers an L0->L1 compaction once L0 holds more
+	// than this many files. L0 files can overlap each other, so every one of
+	// them must be consulted on every read; keeping this low bounds that fan-out.
+	L0CompactionFileCount int
+
+	// L1TargetSizeBytes is L1's target total size. Ln's target (n>=1) is
+	// L1TargetSizeBytes * LevelSizeMultiplier^(n-1); once a level exceeds its
+	// target, one file is picked out of it and merged into the level below.
+	L1TargetSizeBytes int64
+
+	// LevelSizeMultiplier is how much bigger each level's target size is
+	// than the one above it.
+	LevelSizeMultiplier int64
+
+	// L0SlowdownWriteTrigger sleeps each Set/Write call for a short delay
+	// once L0 holds more than this many files, to slow producers down before
+	// things get bad enough to need L0StopWriteTrigger.
+	L0SlowdownWriteTrigger int
+
+	// L0StopWriteTrigger blocks Set/Write calls outright, until the
+	// compactor reports progress, once L0 holds more than this many files.
+	L0StopWriteTrigger int
+
+	// ImemtableStallThreshold blocks Set/Write calls the same way
+	// L0StopWriteTrigger does if the immutable memtable has been waiting
+	// longer than this for flushIMemtable to finish, e.g. because flushing
+	// is itself stuck behind FlushBytesPerSec.
+	ImemtableStallThreshold time.Duration
+
+	// BloomTargetFPRate is passed as sst.WriterOptions.TargetFPRate to the
+	// SSTs written by flush and compaction. 0 means
+	// sst.DefaultWriterOptions' default (1%). sst.Writer does not build a
+	// bloom filter block, so this setting does not change the SSTs written.
+	BloomTargetFPRate float64
+
+	// CompactionTargetFileSizeBytes caps how large a single SST compaction
+	// produces: once a compaction's output writer has written this many
+	// bytes, it's closed and a new output file started, so one compaction
+	// job's result is spread across several disjoint files instead of one
+	// ever-growing one. 0 means unbounded (one output file per job).
+	CompactionTargetFileSizeBytes int64
+
+	// TombstoneGCGrace is how long a deletion tombstone is kept around after
+	// its write timestamp before compaction is allowed to drop it. Dropping
+	// a tombstone too early can resurrect an older, not-yet-compacted-away
+	// value for the same key sitting in a level this compaction job didn't
+	// touch; waiting TombstoneGCGrace is the same time-based heuristic
+	// Cassandra's gc_grace_seconds uses, rather than a strict proof that
+	// every shadowed version has been reached. 0 means tombstones are kept
+	// forever.
+	TombstoneGCGrace time.Duration
+
+	// PerClientWriteLimits throttles Set/Write calls independently per
+	// calling peer (see ratelimit.PerClientLimiter), so one hot client can't
+	// monopolize the WAL fsync loop at everyone else's expense. The zero
+	// value leaves both dimensions unlimited.
+	PerClientWriteLimits ratelimit.PerClientLimits
 }
 
 func DefaultOptions(baseDir string) Options {
@@ -52,26 +183,123 @@ func DefaultOptions(baseDir string) Options {
 		TargetLogSize: 8 * 1024 * 1024,
 
 		DescriptorDir: baseDir,
+
+		L0CompactionFileCount: 4,
+		L1TargetSizeBytes:     64 * 1024 * 1024,
+		LevelSizeMultiplier:   10,
+
+		L0SlowdownWriteTrigger:  8,
+		L0StopWriteTrigger:      12,
+		ImemtableStallThreshold: 10 * time.Second,
+
+		WalMaxInFlightBytes: 64 * 1024 * 1024,
+
+		BloomTargetFPRate: 0.01,
+
+		CompactionTargetFileSizeBytes: 2 * 1024 * 1024,
+		TombstoneGCGrace:              24 * time.Hour,
 	}
 }
 
 func NewServer(opts Options) *Server {
 	return &Server{
-		opts: opts,
-		db:   newDatabase(opts),
+		opts:             opts,
+		db:               newDatabase(opts),
+		writeRateLimiter: ratelimit.NewPerClient(opts.PerClientWriteLimits),
+		snapshots:        make(map[string]*Snapshot),
 	}
 }
 
 func (s *Server) Set(ctx context.Context, req *pb.SetRequest) (*pb.SetResponse, error) {
+	if !s.writeRateLimiter.Allow(peerKey(ctx), int64(len(req.Value))) {
+		return nil, status.Errorf(codes.ResourceExhausted, "per-client write rate limit exceeded")
+	}
 	return s.db.Set(ctx, req)
 }
 
+// Write commits every mutation staged in b atomically (see WriteBatch and
+// database.Write), returning the timestamp assigned to the batch.
+//
+// The gRPC-facing API this is meant to back is Write(ctx, WriteRequest)
+// returns (WriteResponse), but WriteRequest/WriteResponse don't exist in the
+// ddb.proto this server is generated from, and that file isn't part of this
+// checkout to extend (see the pb import above, and the same note on Scan
+// and GetAsOf). This exposes the batch commit directly until that IDL work
+// lands.
+func (s *Server) Write(ctx context.Context, b *WriteBatch) (int64, error) {
+	if !s.writeRateLimiter.Allow(peerKey(ctx), b.byteSize()) {
+		return 0, status.Errorf(codes.ResourceExhausted, "per-client write rate limit exceeded")
+	}
+	return s.db.Write(ctx, b)
+}
+
+// Stats returns the server's observed WAL append throughput.
+func (s *Server) Stats() flowcontrol.Status {
+	return s.db.Stats()
+}
+
+// WriteRateLimiterStats returns a snapshot of every client the per-client
+// write rate limiter has observed so far (see Options.PerClientWriteLimits),
+// e.g. for rendering on the /debug HTTP surface.
+func (s *Server) WriteRateLimiterStats() []ratelimit.ClientStats {
+	return s.writeRateLimiter.Stats()
+}
+
+// WriteStallStats returns how much Set/Write calls have been throttled by
+// L0 or immutable-memtable backpressure (see Options.L0SlowdownWriteTrigger).
+func (s *Server) WriteStallStats() WriteStallStats {
+	return s.db.WriteStallStats()
+}
+
+// WALAdmissionStats returns the WAL writer's admission-control snapshot
+// (see Options.WalMaxInFlightBytes).
+func (s *Server) WALAdmissionStats() WALAdmissionStats {
+	return s.db.WALAdmissionStats()
+}
+
+// Scan returns up to limit rows with keys in [start, end) as of
+// snapshotTs (see database.Scan for the exact semantics).
+//
+// The gRPC-facing API this is meant to back is a streaming
+// Scan(ctx, ScanRequest) returns (stream ScanResponse) RPC, but
+// ScanRequest/ScanResponse and the streaming method don't exist in the
+// ddb.proto this server is generated from, and that file isn't part of this
+// checkout to extend (see the pb import above). This exposes the
+// database-level scan directly until that IDL work lands.
+func (s *Server) Scan(ctx context.Context, start, end string, limit int, snapshotTs int64) ([]KTV, error) {
+	return s.db.Scan(ctx, start, end, limit, snapshotTs)
+}
+
+// ScanIter is like Scan, but returns a live Iter instead of a bounded batch,
+// and reads as of a snapshot token previously returned by NewSnapshot
+// instead of snapshotTs, if token is non-empty (see database.ScanIter and
+// GetAsOf). The caller must Close the returned Iter once done with it.
+//
+// This is meant to back a streaming Scan(ctx, ScanRequest) returns (stream
+// ScanResponse) RPC that chunks rows as they're produced instead of
+// buffering a whole batch, but that streaming method doesn't exist in the
+// ddb.proto this server is generated from, and that file isn't part of this
+// checkout to extend (see the pb import above, and the same note on Scan
+// and GetAsOf). This exposes the iterator directly until that IDL work
+// lands.
+func (s *Server) ScanIter(ctx context.Context, start, end string, token string) (Iter, error) {
+	var snap *Snapshot
+	if token != "" {
+		var err error
+		snap, err = s.snapshot(token)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s.db.ScanIter(ctx, start, end, snap)
+}
+
 func (s *Server) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
 	if err := validateKey(req.Key); err != nil {
 		return nil, err
 	}
 
-	value, err := s.db.Find(ctx, req.Key)
+	value, err := s.db.Find(ctx, req.Key, nil)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "internal error: %v", err)
 	}
@@ -81,3 +309,32 @@ func (s *Server) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse,
 	// TODO: return timestamp of value
 	return &pb.GetResponse{Key: req.Key, Value: value}, nil
 }
+
+// GetAsOf is Get as of a snapshot previously returned by NewSnapshot,
+// instead of the latest state, so a client can make multiple GetAsOf (or,
+// once it exists, ScanAsOf) calls against the same consistent view.
+//
+// There's no SnapshotRequest/SnapshotResponse, nor a snapshot token field on
+// GetRequest, in the ddb.proto this server is generated from, and that file
+// isn't part of this checkout to extend (see the pb import above, and the
+// same note on Scan). So the token is threaded through as a plain string
+// argument until that IDL work lands.
+func (s *Server) GetAsOf(ctx context.Context, req *pb.GetRequest, token string) (*pb.GetResponse, error) {
+	if err := validateKey(req.Key); err != nil {
+		return nil, err
+	}
+
+	snap, err := s.snapshot(token)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := s.db.Find(ctx, req.Key, snap)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "internal error: %v", err)
+	}
+	if value == nil {
+		return nil, status.Errorf(codes.NotFound, "Could not find key %v.", req.Key)
+	}
+	return &pb.GetResponse{Key: req.Key, Value: value}, nil
+}
@@ -22,8 +22,10 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	pb "github.com/danchia/ddb/proto"
+	"github.com/danchia/ddb/ratelimit"
 	"github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
 	"github.com/google/go-cmp/cmp"
@@ -141,6 +143,60 @@ func TestInvalidSet(t *testing.T) {
 	}
 }
 
+func TestSetThrottledUnderSustainedOverage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := DefaultOptions(dir)
+	opts.MaxWriteBytesPerSec = 1
+	s := NewServer(opts)
+
+	value := bytes.Repeat([]byte{1}, 1024)
+	deadline := time.Now().Add(5 * time.Second)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		_, lastErr = s.Set(context.Background(), &pb.SetRequest{Key: "k", Value: value})
+		if lastErr != nil {
+			break
+		}
+	}
+	if lastErr == nil {
+		t.Fatal("Set never got throttled under a 1 byte/sec ceiling")
+	}
+	st, ok := status.FromError(lastErr)
+	if !ok || st.Code() != codes.Unavailable {
+		t.Errorf("Set throttled error = %v, want codes.Unavailable", lastErr)
+	}
+}
+
+func TestSetThrottledByPerClientLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := DefaultOptions(dir)
+	opts.PerClientWriteLimits = ratelimit.PerClientLimits{OpsPerSec: 1, OpsBurst: 1}
+	s := NewServer(opts)
+
+	if _, err := s.Set(context.Background(), &pb.SetRequest{Key: "k", Value: []byte{1}}); err != nil {
+		t.Fatalf("first Set within burst should succeed, got: %v", err)
+	}
+
+	_, err = s.Set(context.Background(), &pb.SetRequest{Key: "k", Value: []byte{1}})
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.ResourceExhausted {
+		t.Errorf("second Set past burst = %v, want codes.ResourceExhausted", err)
+	}
+
+	stats := s.WriteRateLimiterStats()
+	if len(stats) != 1 {
+		t.Fatalf("WriteRateLimiterStats() has %d clients, want 1", len(stats))
+	}
+}
+
 func TestManyReadsAndWrites(t *testing.T) {
 	dir, err := ioutil.TempDir("", "waltest")
 	if err != nil {
@@ -0,0 +1,128 @@
+//    Copyright 2018 Google Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/danchia/ddb/memtable"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Snapshot pins a consistent, point-in-time view of the database as of the
+// sequence number current when it was taken, mirroring goleveldb's
+// db_snapshot.go. Pass it to database.Find to read as of that point instead
+// of the latest state. Every SST the snapshot can see is Ref'd for as long
+// as the snapshot is live, so compaction can rewrite or remove those files
+// from the live levels without invalidating reads already in flight against
+// them; the underlying file itself isn't removed until every Ref/UnRef pair
+// from both the snapshot and any in-flight reads has balanced out.
+//
+// Must be released with Release exactly once.
+type Snapshot struct {
+	seq int64
+
+	// ts is the wall-clock timestamp (see database.Set) current when this
+	// Snapshot was taken. ScanIter uses it as an approximate cut for rows
+	// coming from a still-mutating memtable, since unlike findAsOf it has no
+	// per-row sequence number to filter on at the Iter layer; see ScanIter.
+	ts int64
+
+	memtable  *memtable.Memtable
+	imemtable *memtable.Memtable
+	ssts      []*sstFile
+
+	released bool
+}
+
+// NewSnapshot returns a Snapshot of the database as of the current sequence
+// number.
+func (d *database) NewSnapshot() *Snapshot {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s := &Snapshot{
+		seq:       d.memtable.SequenceUpper(),
+		ts:        time.Now().UnixNano() / 1000,
+		memtable:  d.memtable,
+		imemtable: d.imemtable,
+	}
+	for _, level := range d.levels {
+		for _, f := range level {
+			f.r.Ref()
+			s.ssts = append(s.ssts, f)
+		}
+	}
+	return s
+}
+
+// Release releases the snapshot's pin on every SST it holds. Must be called
+// exactly once, once the snapshot is no longer needed.
+func (s *Snapshot) Release() {
+	if s.released {
+		glog.Fatalf("Snapshot released twice")
+	}
+	s.released = true
+	for _, f := range s.ssts {
+		f.r.UnRef()
+	}
+}
+
+// NewSnapshot takes a snapshot of the database and returns an opaque token
+// identifying it. Pass the token to GetAsOf to read as of this point;
+// release it with ReleaseSnapshot once done so its pinned SSTs can be
+// compacted away.
+func (s *Server) NewSnapshot() string {
+	snap := s.db.NewSnapshot()
+
+	s.snapshotsMu.Lock()
+	defer s.snapshotsMu.Unlock()
+	s.nextSnapshotID++
+	token := strconv.FormatUint(s.nextSnapshotID, 10)
+	s.snapshots[token] = snap
+	return token
+}
+
+// ReleaseSnapshot releases the snapshot token previously returned by
+// NewSnapshot. Returns an error if token is unknown, e.g. already released.
+func (s *Server) ReleaseSnapshot(token string) error {
+	s.snapshotsMu.Lock()
+	snap, ok := s.snapshots[token]
+	if ok {
+		delete(s.snapshots, token)
+	}
+	s.snapshotsMu.Unlock()
+
+	if !ok {
+		return status.Errorf(codes.NotFound, "unknown snapshot token %v", token)
+	}
+	snap.Release()
+	return nil
+}
+
+// snapshot looks up the Snapshot for token.
+func (s *Server) snapshot(token string) (*Snapshot, error) {
+	s.snapshotsMu.Lock()
+	defer s.snapshotsMu.Unlock()
+
+	snap, ok := s.snapshots[token]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown snapshot token %v", token)
+	}
+	return snap, nil
+}
@@ -0,0 +1,124 @@
+//    Copyright 2018 Google Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package server
+
+import (
+	"context"
+
+	"github.com/danchia/ddb/wal"
+	"github.com/golang/glog"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+)
+
+// writeBytesPerSecEMA is flowcontrol.Monitor's smoothed WAL append
+// throughput (see database.Stats and writeLimiter), recorded as an
+// OpenCensus measure so it shows up next to the existing trace.SampledSpans
+// debug output in zpages instead of only being reachable by polling Stats.
+var writeBytesPerSecEMA = stats.Float64("ddb/write_bytes_per_sec_ema", "Smoothed WAL append throughput (flowcontrol.Monitor EMA)", stats.UnitBytes)
+
+// WriteThroughputView exports the most recent writeBytesPerSecEMA
+// measurement; registered in init so any exporter the binary wires up
+// (e.g. zpages' stats handler) picks it up without further setup.
+var WriteThroughputView = &view.View{
+	Name:        "ddb/write_bytes_per_sec_ema",
+	Measure:     writeBytesPerSecEMA,
+	Description: "Smoothed WAL append throughput, see flowcontrol.Monitor",
+	Aggregation: view.LastValue(),
+}
+
+func init() {
+	if err := view.Register(WriteThroughputView); err != nil {
+		glog.Fatalf("failed to register write throughput view: %v", err)
+	}
+}
+
+// recordWriteThroughput records the database's current observed WAL append
+// EMA against writeBytesPerSecEMA. Called on the Set/Write path rather than
+// from flowcontrol.Monitor itself, which has no OpenCensus dependency.
+func recordWriteThroughput(ctx context.Context, emaBytesPerSec float64) {
+	stats.Record(ctx, writeBytesPerSecEMA.M(emaBytesPerSec))
+}
+
+// groupCommitBatchRecords and groupCommitBatchBytes track the size of the
+// WAL writer's most recently fsynced batch (see wal.Options.MaxBatchDelay),
+// so operators can see how effectively concurrent Set/Write calls are being
+// coalesced into a single fsync.
+var groupCommitBatchRecords = stats.Int64("ddb/wal_group_commit_batch_records", "Number of records in the WAL writer's most recent fsync batch", stats.UnitDimensionless)
+var groupCommitBatchBytes = stats.Int64("ddb/wal_group_commit_batch_bytes", "Total encoded bytes in the WAL writer's most recent fsync batch", stats.UnitBytes)
+
+// groupCommitFsyncLatency is how long the most recent WAL fsync call took.
+var groupCommitFsyncLatency = stats.Float64("ddb/wal_group_commit_fsync_latency_ms", "Latency of the WAL writer's most recent fsync call", stats.UnitMilliseconds)
+
+// groupCommitQueueDepth is how many records were still waiting on the WAL
+// writer's recordCh immediately after its most recent batch closed.
+var groupCommitQueueDepth = stats.Int64("ddb/wal_group_commit_queue_depth", "Records queued on the WAL writer's recordCh after its most recent batch closed", stats.UnitDimensionless)
+
+// batchSizeDistribution buckets are chosen to distinguish an unbatched
+// writer (MaxBatchDelay unset, almost always 1) from one amortizing tens to
+// low hundreds of concurrent Set/Write calls per fsync.
+var batchSizeDistribution = view.Distribution(1, 2, 4, 8, 16, 32, 64, 128, 256, 512)
+
+// fsyncLatencyDistribution buckets span a typical disk fsync (sub-ms to
+// tens of ms), matching the range MaxBatchDelay is usually tuned within.
+var fsyncLatencyDistribution = view.Distribution(0.1, 0.5, 1, 2, 5, 10, 20, 50, 100, 250, 500)
+
+var GroupCommitBatchRecordsView = &view.View{
+	Name:        "ddb/wal_group_commit_batch_records",
+	Measure:     groupCommitBatchRecords,
+	Description: "Distribution of WAL fsync batch sizes, in records",
+	Aggregation: batchSizeDistribution,
+}
+
+var GroupCommitBatchBytesView = &view.View{
+	Name:        "ddb/wal_group_commit_batch_bytes",
+	Measure:     groupCommitBatchBytes,
+	Description: "Distribution of WAL fsync batch sizes, in bytes",
+	Aggregation: view.Distribution(64, 256, 1024, 4096, 16384, 65536, 262144, 1048576),
+}
+
+var GroupCommitFsyncLatencyView = &view.View{
+	Name:        "ddb/wal_group_commit_fsync_latency_ms",
+	Measure:     groupCommitFsyncLatency,
+	Description: "Distribution of WAL fsync call latencies",
+	Aggregation: fsyncLatencyDistribution,
+}
+
+var GroupCommitQueueDepthView = &view.View{
+	Name:        "ddb/wal_group_commit_queue_depth",
+	Measure:     groupCommitQueueDepth,
+	Description: "Records queued on the WAL writer after its most recent fsync batch closed",
+	Aggregation: view.LastValue(),
+}
+
+func init() {
+	if err := view.Register(GroupCommitBatchRecordsView, GroupCommitBatchBytesView, GroupCommitFsyncLatencyView, GroupCommitQueueDepthView); err != nil {
+		glog.Fatalf("failed to register group commit views: %v", err)
+	}
+}
+
+// recordGroupCommitStats records the WAL writer's most recently completed
+// batch (see wal.Writer.GroupCommitStats), for the same reason
+// recordWriteThroughput is called from here instead of from wal.Writer
+// itself: wal.Writer is also used standalone where an OpenCensus exporter
+// may not be set up.
+func recordGroupCommitStats(ctx context.Context, s wal.GroupCommitStats) {
+	stats.Record(ctx,
+		groupCommitBatchRecords.M(int64(s.BatchRecords)),
+		groupCommitBatchBytes.M(int64(s.BatchBytes)),
+		groupCommitFsyncLatency.M(float64(s.FsyncLatency.Microseconds())/1000),
+		groupCommitQueueDepth.M(int64(s.QueueDepth)),
+	)
+}
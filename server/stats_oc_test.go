@@ -0,0 +1,46 @@
+//    Copyright 2018 Google Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	pb "github.com/danchia/ddb/proto"
+	"go.opencensus.io/stats/view"
+)
+
+func TestSetRecordsWriteThroughput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewServer(DefaultOptions(dir))
+
+	if _, err := s.Set(context.Background(), &pb.SetRequest{Key: "a", Value: []byte("v")}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	rows, err := view.RetrieveData(WriteThroughputView.Name)
+	if err != nil {
+		t.Fatalf("RetrieveData: %v", err)
+	}
+	if len(rows) == 0 {
+		t.Fatalf("RetrieveData returned no rows after Set, want at least one")
+	}
+}
@@ -0,0 +1,103 @@
+//    Copyright 2018 Google Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package server
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// writeStallSoftDelay is slept once per Set/Write call whenever L0 has
+// crossed L0SlowdownWriteTrigger, to slow producers down before things get
+// bad enough to hit the hard stall below.
+const writeStallSoftDelay = 1 * time.Millisecond
+
+// stallWarnInterval bounds how often maybeStallWrite logs, so a sustained
+// stall doesn't flood the log.
+const stallWarnInterval = 1 * time.Minute
+
+// maybeStallWrite implements LevelDB-style write-delay metering: it slows
+// or blocks the calling goroutine if L0 or the immutable memtable has
+// backed up, so compaction gets a chance to catch up instead of letting
+// memory use grow unbounded. Must be called before appending to the WAL.
+func (d *database) maybeStallWrite() {
+	d.mu.RLock()
+	l0 := len(d.levels[0])
+	hard := d.hardStalledLocked()
+	d.mu.RUnlock()
+
+	soft := l0 > d.opts.L0SlowdownWriteTrigger
+	if !hard && !soft {
+		return
+	}
+
+	start := time.Now()
+	d.logStallWarningOnce(l0)
+
+	if hard {
+		d.waitForCompactionProgress()
+	} else {
+		time.Sleep(writeStallSoftDelay)
+	}
+
+	d.stallMu.Lock()
+	d.writeStallCount++
+	d.writeStallDuration += time.Since(start)
+	d.stallMu.Unlock()
+}
+
+// hardStalledLocked returns whether writes should block outright: either L0
+// is over its hard trigger, or the immutable memtable has been waiting
+// longer than ImemtableStallThreshold for flushIMemtable to finish. Callers
+// must hold d.mu (for reading or writing).
+func (d *database) hardStalledLocked() bool {
+	if len(d.levels[0]) > d.opts.L0StopWriteTrigger {
+		return true
+	}
+	return d.imemtable != nil && !d.imemtableSince.IsZero() &&
+		time.Since(d.imemtableSince) > d.opts.ImemtableStallThreshold
+}
+
+// waitForCompactionProgress blocks until flushIMemtable or a compaction has
+// made enough progress that hardStalledLocked no longer holds.
+func (d *database) waitForCompactionProgress() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for d.hardStalledLocked() {
+		d.compactionCond.Wait()
+	}
+}
+
+// logStallWarningOnce logs a throttled warning at most once per
+// stallWarnInterval, so operators can see when compaction can't keep up
+// without the log filling up during a long backlog.
+func (d *database) logStallWarningOnce(l0 int) {
+	d.stallMu.Lock()
+	defer d.stallMu.Unlock()
+	if time.Since(d.lastStallWarnAt) < stallWarnInterval {
+		return
+	}
+	d.lastStallWarnAt = time.Now()
+	glog.Warningf("write throttled: L0 has %d files, imemtable pending flush: %v", l0, d.imemtable != nil)
+}
+
+// WriteStallStats returns how much Set/Write have been delayed or blocked
+// by maybeStallWrite.
+func (d *database) WriteStallStats() WriteStallStats {
+	d.stallMu.Lock()
+	defer d.stallMu.Unlock()
+	return WriteStallStats{Count: d.writeStallCount, Duration: d.writeStallDuration}
+}
@@ -15,29 +15,65 @@
 package sst
 
 import (
+	"math"
+
 	"github.com/spaolacci/murmur3"
 )
 
-const (
-	bloomHashes int = 7
-	bloomBits   int = 160000
-)
+// defaultTargetFPRate is the false-positive rate a bloom filter is sized
+// for when a caller doesn't ask for a specific one; see
+// WriterOptions.TargetFPRate.
+const defaultTargetFPRate = 0.01
 
-// bloom implements a Bloom filter.
-// TODO(danchia): make size / hashes configurable.
+// bloom implements a Bloom filter sized for a known key count n and target
+// false-positive rate p, rather than a fixed bit/hash count, so a filter
+// built over a handful of keys doesn't waste space and one built over
+// millions of keys doesn't degrade towards returning true for everything.
 type bloom struct {
 	bits []byte
+	m    int // number of bits addressable in bits.
+	k    int // number of hash functions.
+}
+
+// bloomSize returns the number of bits m and hash functions k a bloom
+// filter should use to hold n keys at a target false-positive rate p,
+// using the standard optimal-filter formulas:
+//
+//	m = ceil(-n * ln(p) / ln(2)^2)
+//	k = round((m/n) * ln(2))
+func bloomSize(n int, p float64) (m, k int) {
+	if n <= 0 {
+		n = 1
+	}
+	m = int(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < 8 {
+		m = 8
+	}
+	k = int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return m, k
 }
 
-func newBloom() *bloom {
+// newBloom returns an empty bloom filter sized to hold n keys at false
+// positive rate p.
+func newBloom(n int, p float64) *bloom {
+	m, k := bloomSize(n, p)
 	return &bloom{
-		bits: make([]byte, bloomBits/8+1),
+		bits: make([]byte, m/8+1),
+		m:    m,
+		k:    k,
 	}
 }
 
-func newBloomFromBytes(b []byte) *bloom {
+// newBloomFromBytes reconstructs a bloom filter previously serialized with
+// Bytes, given the m and k it was built with (see filterBlock).
+func newBloomFromBytes(b []byte, m, k int) *bloom {
 	return &bloom{
 		bits: b,
+		m:    m,
+		k:    k,
 	}
 }
 
@@ -51,8 +87,8 @@ func (b *bloom) Add(key []byte) {
 	h1 := murmur3.Sum32(key)
 	h2 := (h1 >> 17) | (h1 << 15)
 	// Mix hash according to Kirsch and Mitzenmacher
-	for i := 0; i < bloomHashes; i++ {
-		p := h1 % uint32(bloomBits)
+	for i := 0; i < b.k; i++ {
+		p := h1 % uint32(b.m)
 		b.bits[p/8] |= (1 << (p % 8))
 		h1 += h2
 	}
@@ -62,8 +98,8 @@ func (b *bloom) Add(key []byte) {
 func (b *bloom) Test(key []byte) bool {
 	h1 := murmur3.Sum32(key)
 	h2 := (h1 >> 17) | (h1 << 15)
-	for i := 0; i < bloomHashes; i++ {
-		p := h1 % uint32(bloomBits)
+	for i := 0; i < b.k; i++ {
+		p := h1 % uint32(b.m)
 		if b.bits[p/8]&(1<<(p%8)) == 0 {
 			return false
 		}
@@ -21,7 +21,7 @@ import (
 )
 
 func TestBasic(t *testing.T) {
-	b := newBloom()
+	b := newBloom(2, defaultTargetFPRate)
 	b.Add([]byte("abc"))
 	b.Add([]byte("bcd"))
 
@@ -40,7 +40,7 @@ func TestPercentile(t *testing.T) {
 	var total, bad int
 	threshold := 0.01
 	for i := 0; i < 50; i++ {
-		fp := runTrial(16000, t)
+		fp := runTrial(16000, threshold, t)
 		if fp > 2*threshold {
 			t.Errorf("Exceedingly bad FP rate: %v", fp)
 		}
@@ -56,20 +56,36 @@ func TestPercentile(t *testing.T) {
 	}
 }
 
-// runTrial returns the false positive ratio
-func runTrial(n int, t *testing.T) float64 {
-	b := newBloom()
+// BenchmarkFPRate verifies that a bloom filter sized for a 1M-key SST (see
+// filterBlockBuilder.Finish) measures a false-positive rate within ~1.5x of
+// its configured target, across filter sizes wildly different from the
+// 16000-key case TestPercentile exercises.
+func BenchmarkFPRate(b *testing.B) {
+	const n = 1000000
+	const target = defaultTargetFPRate
+	for i := 0; i < b.N; i++ {
+		fp := runTrial(n, target, b)
+		if fp > 1.5*target {
+			b.Fatalf("measured FP rate %v exceeds 1.5x target %v for n=%v", fp, target, n)
+		}
+	}
+}
+
+// runTrial returns the false positive ratio for a bloom filter of n keys
+// sized for a target false-positive rate of p.
+func runTrial(n int, p float64, t testing.TB) float64 {
+	bl := newBloom(n, p)
 	keys := make(map[string]struct{})
 
 	for i := 0; i < n; i++ {
 		key := fmt.Sprint(rand.Int31())
 		keys[key] = struct{}{}
-		b.Add([]byte(key))
+		bl.Add([]byte(key))
 	}
 
 	// Validate all added keys still test ok.
 	for k := range keys {
-		if !b.Test([]byte(k)) {
+		if !bl.Test([]byte(k)) {
 			t.Fatalf("b.Test(%v)=false, expected true for added key", string(k))
 		}
 	}
@@ -79,7 +95,7 @@ func runTrial(n int, t *testing.T) float64 {
 	for i := 0; i < 5000; i++ {
 		key := fmt.Sprint(rand.Int31())
 		if _, found := keys[key]; !found {
-			if b.Test([]byte(key)) {
+			if bl.Test([]byte(key)) {
 				hits++
 			}
 		}
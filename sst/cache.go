@@ -16,6 +16,8 @@ package sst
 
 import (
 	"container/list"
+	"encoding/binary"
+	"strings"
 	"sync"
 
 	"github.com/golang/glog"
@@ -101,6 +103,32 @@ func (c *Cache) Get(key string) []byte {
 	return nil
 }
 
+// EvictID drops every cached block belonging to the file that was issued
+// id by NewID. Callers (e.g. compaction) use this to free cache space for a
+// file as soon as it's deleted, rather than waiting for those blocks to age
+// out of the LRU on their own.
+func (c *Cache) EvictID(id uint64) {
+	var prefix [8]byte
+	binary.LittleEndian.PutUint64(prefix[:], id)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, e := range c.entries {
+		if !strings.HasPrefix(key, string(prefix[:])) {
+			continue
+		}
+		ce := e.Value.(cacheEntry)
+		if ce.old {
+			c.old.Remove(e)
+			c.oldSize -= int64(len(ce.data))
+		} else {
+			c.young.Remove(e)
+			c.youngSize -= int64(len(ce.data))
+		}
+		delete(c.entries, key)
+	}
+}
+
 func (c *Cache) Insert(key string, data []byte) {
 	size := int64(len(data))
 
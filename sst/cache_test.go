@@ -15,6 +15,7 @@
 package sst
 
 import (
+	"encoding/binary"
 	"fmt"
 	"testing"
 
@@ -71,3 +72,34 @@ func TestEvict(t *testing.T) {
 		t.Errorf("b should still be present, Get(b)=%v != %v", got, want)
 	}
 }
+
+func TestEvictID(t *testing.T) {
+	c := NewCache(100)
+
+	id1 := c.NewID()
+	id2 := c.NewID()
+
+	var k1a, k1b, k2 [9]byte
+	binary.LittleEndian.PutUint64(k1a[:8], id1)
+	k1a[8] = 'a'
+	binary.LittleEndian.PutUint64(k1b[:8], id1)
+	k1b[8] = 'b'
+	binary.LittleEndian.PutUint64(k2[:8], id2)
+	k2[8] = 'a'
+
+	c.Insert(string(k1a[:]), []byte{1})
+	c.Insert(string(k1b[:]), []byte{2})
+	c.Insert(string(k2[:]), []byte{3})
+
+	c.EvictID(id1)
+
+	if got := c.Get(string(k1a[:])); got != nil {
+		t.Errorf("id1 block a should be evicted, got %v", got)
+	}
+	if got := c.Get(string(k1b[:])); got != nil {
+		t.Errorf("id1 block b should be evicted, got %v", got)
+	}
+	if got, want := c.Get(string(k2[:])), []byte{3}; !cmp.Equal(got, want) {
+		t.Errorf("id2 block should survive EvictID(id1), got %v != %v", got, want)
+	}
+}
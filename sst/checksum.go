@@ -0,0 +1,27 @@
+package sst
+
+import (
+	"hash"
+	"hash/crc32"
+
+	"github.com/cespare/xxhash/v2"
+	"golang.org/x/crypto/blake2b"
+)
+
+// newHasher returns a streaming hash.Hash implementing ct. Sum(nil) will
+// return checksumSize(ct) bytes.
+func newHasher(ct ChecksumType) hash.Hash {
+	switch ct {
+	case ChecksumXXHash64:
+		return xxhash.New()
+	case ChecksumBLAKE2b256:
+		h, err := blake2b.New256(nil)
+		if err != nil {
+			// Only possible with a non-nil key, which we never pass.
+			panic(err)
+		}
+		return h
+	default:
+		return crc32.New(crcTable)
+	}
+}
@@ -11,6 +11,15 @@ const (
 	SstMagic   = uint64(0xe489f8a9d479536b)
 	MaxKeySize = 8 * 1024
 
+	// MaxSstKeySize is the maximum size of a key as encoded on disk (the raw
+	// key plus orderedcode escaping and the trailing timestamp component),
+	// used to size key-decoding scratch buffers.
+	MaxSstKeySize = MaxKeySize + 16
+
+	// footerSize is the size of the original fixed footer format, which has
+	// no checksum-type byte and is implicitly CRC32. Files written since the
+	// introduction of ChecksumType append one extra trailing byte; see
+	// Reader.readFooter.
 	footerSize = binary.MaxVarintLen64 + 4 + 8
 )
 
@@ -21,6 +30,52 @@ const (
 
 const blockSize = 16 * 1024
 
+// CompressionType identifies the codec used to compress an individual block.
+// It is stored as a single trailer byte between the block payload and its
+// checksum, following the LevelDB/RocksDB convention.
+type CompressionType byte
+
+const (
+	CompressionNone   CompressionType = 0
+	CompressionSnappy CompressionType = 1
+	CompressionZstd   CompressionType = 2
+)
+
+// ChecksumType identifies the hash function used to verify a block's
+// integrity. Like CompressionType, it is stored as a trailer byte so each
+// block is self-describing. CRC32C remains the default for compatibility;
+// xxHash64 is roughly 5x faster and recommended when Find CPU overhead on
+// cache misses matters more than cross-implementation familiarity; BLAKE2b256
+// is for deployments that want cryptographic integrity guarantees.
+type ChecksumType byte
+
+const (
+	ChecksumCRC32      ChecksumType = 0
+	ChecksumXXHash64   ChecksumType = 1
+	ChecksumBLAKE2b256 ChecksumType = 2
+)
+
+// checksumSize returns the number of trailer bytes occupied by a checksum of
+// type ct.
+func checksumSize(ct ChecksumType) int {
+	switch ct {
+	case ChecksumXXHash64:
+		return 8
+	case ChecksumBLAKE2b256:
+		return 32
+	default:
+		return 4
+	}
+}
+
+// blockTrailerSize returns the number of bytes following a block's payload
+// on disk for checksum type ct: 1 byte for the CompressionType, 1 byte for
+// the ChecksumType, followed by checksumSize(ct) bytes of checksum covering
+// the payload and both type bytes.
+func blockTrailerSize(ct ChecksumType) int {
+	return 2 + checksumSize(ct)
+}
+
 var crcTable = crc32.MakeTable(crc32.Castagnoli)
 
 var (
@@ -30,7 +85,9 @@ var (
 
 type blockHandle struct {
 	offset uint64
-	// size is the size of the block. Does not include checksum.
+	// size is the size of the block's payload as stored on disk, i.e. after
+	// compression. Does not include the block trailer (compression type byte
+	// and checksum).
 	size uint64
 }
 
@@ -0,0 +1,57 @@
+package sst
+
+import (
+	"fmt"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// defaultMinCompressionRatio is the WriterOptions.MinCompressionRatio used
+// by DefaultWriterOptions: the threshold above which a compressed block is
+// discarded in favour of storing it raw - compressing 4KB-ish blocks that
+// don't shrink meaningfully just costs CPU on every future read.
+const defaultMinCompressionRatio = 0.9
+
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+// compressBlock compresses data with the requested codec, returning the
+// encoded bytes and the CompressionType actually used. If the compressed
+// result is larger than minRatio times the raw size, or data is smaller
+// than minSize, the block is stored uncompressed.
+func compressBlock(data []byte, ct CompressionType, minSize int, minRatio float64) ([]byte, CompressionType) {
+	if ct == CompressionNone || len(data) < minSize {
+		return data, CompressionNone
+	}
+
+	var compressed []byte
+	switch ct {
+	case CompressionSnappy:
+		compressed = snappy.Encode(nil, data)
+	case CompressionZstd:
+		compressed = zstdEncoder.EncodeAll(data, nil)
+	default:
+		return data, CompressionNone
+	}
+
+	if float64(len(compressed)) > minRatio*float64(len(data)) {
+		return data, CompressionNone
+	}
+	return compressed, ct
+}
+
+// decompressBlock reverses compressBlock given the CompressionType read from
+// the block trailer.
+func decompressBlock(data []byte, ct CompressionType) ([]byte, error) {
+	switch ct {
+	case CompressionNone:
+		return data, nil
+	case CompressionSnappy:
+		return snappy.Decode(nil, data)
+	case CompressionZstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	default:
+		return nil, fmt.Errorf("sst: unknown compression type %d", ct)
+	}
+}
@@ -22,6 +22,11 @@ import (
 	"github.com/google/orderedcode"
 )
 
+// defaultRestartInterval is the restartInterval newDataBlockBuilder uses
+// when none is specified, matching LevelDB's default of a full key every 16
+// entries.
+const defaultRestartInterval = 16
+
 type dataBlockBuilder struct {
 	buf           *bytes.Buffer
 	prefixEncoder *prefixEncoder
@@ -30,10 +35,10 @@ type dataBlockBuilder struct {
 	tmpKey []byte
 }
 
-func newDataBlockBuilder() *dataBlockBuilder {
+func newDataBlockBuilder(restartInterval int32) *dataBlockBuilder {
 	return &dataBlockBuilder{
 		buf:           new(bytes.Buffer),
-		prefixEncoder: newPrefixEncoder(16),
+		prefixEncoder: newPrefixEncoder(restartInterval),
 	}
 }
 
@@ -183,3 +188,156 @@ func parseEKey(eKey string) (key string, ts int64, err error) {
 	}
 	return readKey, ts, nil
 }
+
+// seekToRestart repositions the block's reader to the i'th restart point.
+func (b *dataBlock) seekToRestart(i int) error {
+	_, err := b.r.Seek(int64(b.restarts[i]), io.SeekStart)
+	return err
+}
+
+// restartIndexForKey returns the index of the last restart point whose first
+// key is <= key, via the same binary search Find uses.
+func (b *dataBlock) restartIndexForKey(key string) (int, error) {
+	kb := make([]byte, 0, MaxSstKeySize)
+	i, j := 0, len(b.restarts)-1
+	for i < j {
+		h := int(uint(i+j+1) >> 1)
+		if err := b.seekToRestart(h); err != nil {
+			return 0, err
+		}
+		eKey, err := prefixDecodeFrom(b.r, nil, kb)
+		if err != nil {
+			return 0, err
+		}
+		readKey, _, err := parseEKey(string(eKey))
+		if err != nil {
+			return 0, err
+		}
+		if readKey < key {
+			i = h
+		} else {
+			j = h - 1
+		}
+	}
+	return i, nil
+}
+
+// next decodes the entry at the reader's current position and advances past
+// it. lastKey is the previously decoded entry's raw encoded key (nil at a
+// restart point); scratch is reused as decoding space for the returned key.
+// ok is false once the block is exhausted.
+func (b *dataBlock) next(lastKey []byte, scratch []byte) (eKey []byte, key string, ts int64, value []byte, ok bool, err error) {
+	if b.r.Len() == 0 {
+		return nil, "", 0, nil, false, nil
+	}
+
+	eKey, err = prefixDecodeFrom(b.r, lastKey, scratch)
+	if err != nil {
+		return nil, "", 0, nil, false, err
+	}
+	key, ts, err = parseEKey(string(eKey))
+	if err != nil {
+		return nil, "", 0, nil, false, err
+	}
+
+	valueLen, err := binary.ReadUvarint(b.r)
+	if err != nil {
+		return nil, "", 0, nil, false, err
+	}
+	raw := make([]byte, valueLen)
+	if _, err = io.ReadFull(b.r, raw); err != nil {
+		return nil, "", 0, nil, false, err
+	}
+	if raw[0] != typeNil {
+		value = raw[1:]
+	}
+	return eKey, key, ts, value, true, nil
+}
+
+// dataBlockIter is a forward iterator over the rows of a single data block.
+type dataBlockIter struct {
+	b       *dataBlock
+	lastKey []byte
+	kb      []byte
+
+	key   string
+	ts    int64
+	value []byte
+	valid bool
+	err   error
+}
+
+// NewIter returns an iterator positioned before the block's first row.
+func (b *dataBlock) NewIter() *dataBlockIter {
+	return &dataBlockIter{b: b, kb: make([]byte, 0, MaxSstKeySize)}
+}
+
+// SeekGE positions the iterator at the first row with key >= the given key,
+// using the block's restart array to binary search for the containing
+// restart range before scanning forward. Returns whether such a row exists.
+func (it *dataBlockIter) SeekGE(key string) bool {
+	idx, err := it.b.restartIndexForKey(key)
+	if err != nil {
+		it.err = err
+		it.valid = false
+		return false
+	}
+	if err := it.b.seekToRestart(idx); err != nil {
+		it.err = err
+		it.valid = false
+		return false
+	}
+	it.lastKey = nil
+
+	for {
+		eKey, k, ts, v, ok, err := it.b.next(it.lastKey, it.kb)
+		if err != nil {
+			it.err = err
+			it.valid = false
+			return false
+		}
+		if !ok {
+			it.valid = false
+			return false
+		}
+		it.lastKey = eKey
+		if k >= key {
+			it.key, it.ts, it.value = k, ts, v
+			it.valid = true
+			return true
+		}
+	}
+}
+
+// Next advances the iterator. Returns true if there is a next row.
+func (it *dataBlockIter) Next() bool {
+	eKey, k, ts, v, ok, err := it.b.next(it.lastKey, it.kb)
+	if err != nil {
+		it.err = err
+		it.valid = false
+		return false
+	}
+	if !ok {
+		it.valid = false
+		return false
+	}
+	it.lastKey = eKey
+	it.key, it.ts, it.value = k, ts, v
+	it.valid = true
+	return true
+}
+
+// Valid returns whether the iterator is positioned at a row.
+func (it *dataBlockIter) Valid() bool { return it.valid }
+
+// Key returns the current row's key.
+func (it *dataBlockIter) Key() string { return it.key }
+
+// Timestamp returns the current row's timestamp.
+func (it *dataBlockIter) Timestamp() int64 { return it.ts }
+
+// Value returns the current row's value.
+func (it *dataBlockIter) Value() []byte { return it.value }
+
+// Err returns the first error encountered while decoding, if any.
+func (it *dataBlockIter) Err() error { return it.err }
@@ -14,32 +14,80 @@
 
 package sst
 
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// filterBlockBuilder buffers the keys appended to an SST so the bloom
+// filter covering them can be sized for the exact key count seen, rather
+// than a fixed capacity, once Finish is called (see bloomSize).
+//
+// TODO(danchia): Writer doesn't build or emit a filter block, so this isn't
+// wired into the SST format. Reader.Find does read and test a filter block,
+// at the handle parseFooterBody decodes from the footer. Wiring it in needs
+// a footer format change to point at the block; tracked separately.
 type filterBlockBuilder struct {
-	bloom *bloom
+	targetFPRate float64
+	keys         [][]byte
 }
 
-func newFilterBlockBuilder() *filterBlockBuilder {
-	return &filterBlockBuilder{bloom: newBloom()}
+// newFilterBlockBuilder returns a filterBlockBuilder that sizes its bloom
+// filter for a target false-positive rate of p. p <= 0 means
+// defaultTargetFPRate.
+func newFilterBlockBuilder(p float64) *filterBlockBuilder {
+	if p <= 0 {
+		p = defaultTargetFPRate
+	}
+	return &filterBlockBuilder{targetFPRate: p}
 }
 
 // Append adds a key to the filter block.
 func (b *filterBlockBuilder) Append(key string) {
-	b.bloom.Add([]byte(key))
+	b.keys = append(b.keys, []byte(key))
 }
 
-// Finish finishes building the filter block and returns a slice to its contents.
+// Finish builds a bloom filter sized for the keys seen so far and returns
+// the filter block's on-disk encoding: varint m, varint k, then the bit
+// array (see newFilterBlock).
 func (b *filterBlockBuilder) Finish() []byte {
-	return b.bloom.Bytes()
+	bl := newBloom(len(b.keys), b.targetFPRate)
+	for _, k := range b.keys {
+		bl.Add(k)
+	}
+
+	var out bytes.Buffer
+	var vb [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(vb[:], uint64(bl.m))
+	out.Write(vb[:n])
+	n = binary.PutUvarint(vb[:], uint64(bl.k))
+	out.Write(vb[:n])
+	out.Write(bl.Bytes())
+	return out.Bytes()
 }
 
+// filterBlock wraps the bloom filter decoded from a filterBlockBuilder's
+// Finish output.
 type filterBlock struct {
 	bloom *bloom
 }
 
-func newFilterBlock(b []byte) *filterBlock {
-	return &filterBlock{
-		bloom: newBloomFromBytes(b),
+// newFilterBlock decodes a filter block previously written by
+// filterBlockBuilder.Finish.
+func newFilterBlock(b []byte) (*filterBlock, error) {
+	buf := bytes.NewReader(b)
+	m, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return nil, err
 	}
+	k, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return nil, err
+	}
+	bits := b[len(b)-buf.Len():]
+	return &filterBlock{
+		bloom: newBloomFromBytes(bits, int(m), int(k)),
+	}, nil
 }
 
 func (b *filterBlock) Test(key string) bool {
@@ -0,0 +1,46 @@
+//    Copyright 2018 Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package sst
+
+import "testing"
+
+func TestFilterBlockRoundTrip(t *testing.T) {
+	keys := []string{"abc", "bcd", "cde", "def", "efg"}
+
+	b := newFilterBlockBuilder(defaultTargetFPRate)
+	for _, k := range keys {
+		b.Append(k)
+	}
+
+	fb, err := newFilterBlock(b.Finish())
+	if err != nil {
+		t.Fatalf("newFilterBlock: %v", err)
+	}
+
+	for _, k := range keys {
+		if !fb.Test(k) {
+			t.Errorf("fb.Test(%v)=false, wanted true for added key", k)
+		}
+	}
+	if fb.Test("not-in-filter") {
+		t.Logf("fb.Test(not-in-filter)=true, a false positive (not itself an error)")
+	}
+}
+
+func TestNewFilterBlockCorrupt(t *testing.T) {
+	if _, err := newFilterBlock(nil); err == nil {
+		t.Errorf("newFilterBlock(nil) returned nil error, wanted an error")
+	}
+}
@@ -78,6 +78,42 @@ func newIndexBlock(d []byte) *indexBlock {
 	}
 }
 
+// indexEntry is a single (lastKey, blockHandle) pair decoded from an index
+// block, where lastKey is the largest key stored in the data block described
+// by bh.
+type indexEntry struct {
+	lastKey string
+	bh      blockHandle
+}
+
+// entries decodes every entry in the index block, in ascending key order.
+func (b *indexBlock) entries() ([]indexEntry, error) {
+	if _, err := b.r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	kb := make([]byte, 0, MaxSstKeySize)
+	var lastKey []byte
+	var entries []indexEntry
+	for b.r.Len() > 0 {
+		eKey, err := prefixDecodeFrom(b.r, lastKey, kb)
+		if err != nil {
+			return nil, err
+		}
+		lastKey = eKey
+
+		if _, err := binary.ReadUvarint(b.r); err != nil {
+			return nil, err
+		}
+		bh, err := newBlockHandle(b.r)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, indexEntry{lastKey: string(eKey), bh: bh})
+	}
+	return entries, nil
+}
+
 func (b *indexBlock) Find(key string) (blockHandle, error) {
 	var bh blockHandle
 	kb := make([]byte, 0, MaxSstKeySize)
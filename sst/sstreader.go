@@ -20,41 +20,97 @@ import (
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
-	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
 
+	"github.com/danchia/ddb/vfs"
 	"github.com/golang/glog"
 )
 
 // Reader is an SSTable reader.
 // Threadsafe.
 type Reader struct {
-	f        *os.File
+	f        vfs.File
 	fLength  int64
 	filename string
 
 	indexBlockHandle  blockHandle
 	filterBlockHandle blockHandle
 
+	// checksumType is the codec this file's blocks were written with, read
+	// from the footer. Defaults to ChecksumCRC32 for files written before
+	// ChecksumType existed. Individual blocks are self-describing (see
+	// readRawBlock), so this is mostly informative, e.g. for a compactor that
+	// wants to preserve a file's existing checksum codec.
+	checksumType ChecksumType
+
+	// legacyBlockFormat is true for files written before CompressionType and
+	// ChecksumType existed, i.e. before the footer grew its trailing
+	// checksum-type byte. Their blocks have no type-byte trailer at all: just
+	// the (always-uncompressed) payload followed by a bare 4 byte CRC32.
+	legacyBlockFormat bool
+
 	cache   *Cache
 	cacheID uint64
+
+	// refs starts at 1 for the reference NewReader/NewReaderFS hands back,
+	// e.g. a database's membership of this file in a level. Ref/UnRef let a
+	// Snapshot or scan iterator pin the file past the point the database
+	// would otherwise close it, without the caller needing its own
+	// bookkeeping for "is the underlying file still open".
+	refs int32
+}
+
+// ChecksumType returns the checksum codec this file's blocks were written
+// with.
+func (r *Reader) ChecksumType() ChecksumType {
+	return r.checksumType
+}
+
+// SizeBytes returns the on-disk size of the SST, including its footer,
+// index, and filter blocks. Used by leveled compaction to size levels.
+func (r *Reader) SizeBytes() int64 {
+	return r.fLength
 }
 
+// CacheID returns the ID this Reader's blocks are cached under (see
+// readRawBlock), or 0 if it was opened without a Cache. Used by compaction
+// to evict a file's cached blocks as soon as it's deleted, via
+// Cache.EvictID.
+func (r *Reader) CacheID() uint64 {
+	return r.cacheID
+}
+
+// Filename returns the path this Reader was opened with.
+func (r *Reader) Filename() string {
+	return r.filename
+}
+
+// NewReader returns a Reader for filename on the local filesystem. Use
+// NewReaderFS to read from an alternative vfs.FS.
 func NewReader(filename string, cache *Cache) (*Reader, error) {
-	f, err := os.Open(filename)
+	return NewReaderFS(filename, cache, vfs.Default)
+}
+
+// NewReaderFS returns a Reader for filename on fs.
+func NewReaderFS(filename string, cache *Cache, fs vfs.FS) (*Reader, error) {
+	f, err := fs.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	fInfo, err := f.Stat()
+	size, err := f.Size()
 	if err != nil {
 		return nil, err
 	}
 
 	r := &Reader{
 		f:        f,
-		fLength:  fInfo.Size(),
+		fLength:  size,
 		filename: filename,
 		cache:    cache,
+		refs:     1,
 	}
 	if err := r.readFooter(); err != nil {
 		return nil, fmt.Errorf("error while reading footer: %v", err)
@@ -65,6 +121,27 @@ func NewReader(filename string, cache *Cache) (*Reader, error) {
 	return r, nil
 }
 
+// Ref increments r's reference count. Callers that want to keep reading
+// from r past the point the owning database might otherwise close it (a
+// pinned Snapshot, a live scan iterator, or a compaction job reading its
+// inputs) must call Ref before releasing whatever lock protects the
+// database's view of live files, and UnRef exactly once when done.
+func (r *Reader) Ref() {
+	atomic.AddInt32(&r.refs, 1)
+}
+
+// UnRef decrements r's reference count, closing the underlying file once
+// no reference remains.
+func (r *Reader) UnRef() {
+	if n := atomic.AddInt32(&r.refs, -1); n == 0 {
+		if err := r.f.Close(); err != nil {
+			glog.Warningf("error closing sst file %v: %v", r.filename, err)
+		}
+	} else if n < 0 {
+		glog.Fatalf("sst.Reader UnRef called more times than Ref for %v", r.filename)
+	}
+}
+
 // NewIter returns a new SST iterator. Must close after use.
 func (r *Reader) NewIter() (*Iter, error) {
 	return newIter(r)
@@ -74,6 +151,9 @@ func (r *Reader) NewIter() (*Iter, error) {
 func (r *Reader) Find(ctx context.Context, key string) (value []byte, ts int64, err error) {
 	/// Test filter block for presence
 	fb, err := r.getFilterBlock()
+	if err != nil {
+		return nil, 0, err
+	}
 	if !fb.Test(key) {
 		return nil, 0, ErrNotFound
 	}
@@ -97,7 +177,11 @@ func (r *Reader) getFilterBlock() (*filterBlock, error) {
 	if err != nil {
 		return nil, err
 	}
-	return newFilterBlock(bd), nil
+	fb, err := newFilterBlock(bd)
+	if err != nil {
+		return nil, err
+	}
+	return fb, nil
 }
 
 // findDataBlock finds the first data block containing key.
@@ -131,23 +215,88 @@ func (r *Reader) readRawBlock(h blockHandle, fillCache bool) ([]byte, error) {
 		}
 	}
 
+	var bd []byte
+	if r.legacyBlockFormat {
+		var err error
+		bd, err = r.readLegacyRawBlock(h)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// The checksum's size depends on its type, which is itself a trailer
+		// byte, so the payload and the two type bytes are read first, and the
+		// checksum (whose length is now known) is read in a second pass.
+		head := make([]byte, h.size+2)
+		if _, err := r.f.ReadAt(head, int64(h.offset)); err != nil {
+			return nil, err
+		}
+		payload := head[:h.size]
+		ct := CompressionType(head[h.size])
+		cksumType := ChecksumType(head[h.size+1])
+
+		sum := make([]byte, checksumSize(cksumType))
+		if _, err := r.f.ReadAt(sum, int64(h.offset)+int64(len(head))); err != nil {
+			return nil, err
+		}
+
+		hh := newHasher(cksumType)
+		hh.Write(payload)
+		hh.Write(head[h.size:])
+		if !bytes.Equal(hh.Sum(nil), sum) {
+			glog.V(2).Infof("sst block corrupt, checksum mismatch. blockHandle: %v", h)
+			return nil, ErrCorruption
+		}
+
+		var err error
+		bd, err = decompressBlock(payload, ct)
+		if err != nil {
+			glog.V(2).Infof("sst block corrupt, could not decompress. blockHandle: %v, codec: %v", h, ct)
+			return nil, ErrCorruption
+		}
+	}
+
+	if r.cache != nil && fillCache {
+		r.cache.Insert(cacheKey, bd)
+	}
+	return bd, nil
+}
+
+// readLegacyRawBlock reads a block written before CompressionType and
+// ChecksumType existed: the (always-uncompressed) payload followed directly
+// by a bare 4 byte CRC32 checksum, with no type-byte trailer.
+func (r *Reader) readLegacyRawBlock(h blockHandle) ([]byte, error) {
 	raw := make([]byte, h.size+4)
 	if _, err := r.f.ReadAt(raw, int64(h.offset)); err != nil {
 		return nil, err
 	}
-	bd := raw[:h.size]
-	if !verifyChecksum(bd, raw[h.size:]) {
+	payload := raw[:h.size]
+	if !verifyChecksum(payload, raw[h.size:]) {
 		glog.V(2).Infof("sst block corrupt, checksum mismatch. blockHandle: %v", h)
 		return nil, ErrCorruption
 	}
-
-	if r.cache != nil && fillCache {
-		r.cache.Insert(cacheKey, bd)
-	}
-	return bd, nil
+	return payload, nil
 }
 
+// readFooter reads and parses the SST footer. Files written after
+// ChecksumType was introduced have one extra trailing byte identifying the
+// block checksum codec; older files don't, and are assumed to be ChecksumCRC32.
 func (r *Reader) readFooter() error {
+	if r.fLength >= footerSize+1 {
+		footer := make([]byte, footerSize+1)
+		if _, err := r.f.ReadAt(footer, r.fLength-(footerSize+1)); err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint64(footer[footerSize-8:footerSize]) == SstMagic {
+			if err := r.parseFooterBody(footer[:footerSize]); err != nil {
+				return err
+			}
+			r.checksumType = ChecksumType(footer[footerSize])
+			return nil
+		}
+	}
+
+	// Fall back to the original fixed-size footer, written before files
+	// recorded a checksum codec.
 	if r.fLength < footerSize {
 		glog.Warningf("sst file is too small to have footer. file: %v", r.filename)
 		return ErrCorruption
@@ -156,6 +305,18 @@ func (r *Reader) readFooter() error {
 	if _, err := r.f.ReadAt(footer, r.fLength-footerSize); err != nil {
 		return err
 	}
+	if err := r.parseFooterBody(footer); err != nil {
+		return err
+	}
+	r.checksumType = ChecksumCRC32
+	r.legacyBlockFormat = true
+	return nil
+}
+
+// parseFooterBody validates and parses a footerSize-length footer (excluding
+// the optional trailing checksum-type byte), populating indexBlockHandle and
+// filterBlockHandle.
+func (r *Reader) parseFooterBody(footer []byte) error {
 	if binary.LittleEndian.Uint64(footer[footerSize-8:]) != SstMagic {
 		glog.Warningf("sst footer has invalid magic. file: %v", r.filename)
 		return ErrCorruption
@@ -189,10 +350,20 @@ func verifyChecksum(data []byte, sum []byte) bool {
 	return ec == c
 }
 
+// Iter is a forward iterator over an SST's rows. Data blocks are loaded from
+// the Reader on demand as the iterator crosses block boundaries, rather than
+// all up front. Must be closed after use.
 type Iter struct {
-	r          *Reader
-	nextDBlock int
-	dBlocks    []blockHandle
+	r        *Reader
+	entries  []indexEntry
+	blockIdx int
+
+	// end is the exclusive upper bound set by NewRangeIterator; empty means
+	// unbounded above.
+	end string
+
+	cur *dataBlockIter
+	err error
 }
 
 func newIter(r *Reader) (*Iter, error) {
@@ -202,13 +373,192 @@ func newIter(r *Reader) (*Iter, error) {
 	}
 	ib := newIndexBlock(ibd)
 
-	dBlocks, err := ib.Blocks()
+	entries, err := ib.entries()
 	if err != nil {
 		return nil, err
 	}
-	return &Iter{r: r, dBlocks: dBlocks}, nil
+	return &Iter{r: r, entries: entries, blockIdx: -1}, nil
 }
 
-func (i *Iter) Next() (bool, err) {
+// NewRangeIterator returns an Iter positioned at the first row with key in
+// [start, end), using the index block to locate the first data block to
+// stream from. An empty end means unbounded above. Must be closed after use.
+func (r *Reader) NewRangeIterator(start, end string) (*Iter, error) {
+	it, err := newIter(r)
+	if err != nil {
+		return nil, err
+	}
+	it.end = end
+	it.SeekGE(start)
+	return it, nil
+}
+
+// clampEnd invalidates the iterator if it has advanced to or past end.
+// Returns whether the iterator is still positioned at a row.
+func (i *Iter) clampEnd() bool {
+	if i.end != "" && i.cur != nil && i.cur.Key() >= i.end {
+		i.cur = nil
+		i.blockIdx = len(i.entries)
+	}
+	return i.cur != nil
+}
+
+// KeyRange returns the smallest and largest key stored in the SST, read from
+// its first data block and its index block respectively. Used by leveled
+// compaction to re-derive a file's key range after a restart, since a
+// Reader doesn't otherwise track it (see sstFile in package server).
+func (r *Reader) KeyRange() (first, last string, err error) {
+	it, err := r.NewIter()
+	if err != nil {
+		return "", "", err
+	}
+	defer it.Close()
+	if !it.Next() {
+		if it.Err() != nil {
+			return "", "", it.Err()
+		}
+		return "", "", nil
+	}
+	first = it.Key()
+
+	ibd, err := r.readRawBlock(r.indexBlockHandle, false)
+	if err != nil {
+		return "", "", err
+	}
+	entries, err := newIndexBlock(ibd).entries()
+	if err != nil {
+		return "", "", err
+	}
+	last = entries[len(entries)-1].lastKey
+	return first, last, nil
+}
+
+// loadBlock loads and returns an iterator over the idx'th data block.
+func (i *Iter) loadBlock(idx int) (*dataBlockIter, error) {
+	bd, err := i.r.readRawBlock(i.entries[idx].bh, true)
+	if err != nil {
+		return nil, err
+	}
+	return newDataBlock(bd).NewIter(), nil
+}
+
+// advanceToNextBlock loads the first non-empty data block after blockIdx,
+// positioned at its first row.
+func (i *Iter) advanceToNextBlock() bool {
+	for {
+		i.blockIdx++
+		if i.blockIdx >= len(i.entries) {
+			i.cur = nil
+			return false
+		}
+
+		bi, err := i.loadBlock(i.blockIdx)
+		if err != nil {
+			i.err = err
+			i.cur = nil
+			return false
+		}
+		if bi.Next() {
+			i.cur = bi
+			return true
+		}
+		if bi.Err() != nil {
+			i.err = bi.Err()
+			i.cur = nil
+			return false
+		}
+		// Empty block; keep looking.
+	}
+}
+
+// SeekGE positions the iterator at the first row with key >= the given key,
+// using the index block to find the containing data block and that block's
+// restart array to binary search within it. Returns whether such a row
+// exists.
+func (i *Iter) SeekGE(key string) bool {
+	idx := sort.Search(len(i.entries), func(n int) bool {
+		return i.entries[n].lastKey >= key
+	})
+	if idx == len(i.entries) {
+		i.blockIdx = idx
+		i.cur = nil
+		return false
+	}
+
+	bi, err := i.loadBlock(idx)
+	if err != nil {
+		i.err = err
+		i.blockIdx = idx
+		i.cur = nil
+		return false
+	}
+	i.blockIdx = idx
+
+	if bi.SeekGE(key) {
+		i.cur = bi
+		return i.clampEnd()
+	}
+	if bi.Err() != nil {
+		i.err = bi.Err()
+		i.cur = nil
+		return false
+	}
+	// Defensively handle a block whose last key is stale relative to key;
+	// shouldn't happen given the index's invariants, but fall through.
+	i.cur = bi
+	if !i.advanceToNextBlock() {
+		return false
+	}
+	return i.clampEnd()
+}
 
+// SeekPrefix positions the iterator at the first row whose key has the given
+// prefix. Returns whether such a row exists. Does not bound subsequent Next
+// calls to the prefix; callers should check Key() themselves.
+func (i *Iter) SeekPrefix(prefix string) bool {
+	if !i.SeekGE(prefix) {
+		return false
+	}
+	if !strings.HasPrefix(i.Key(), prefix) {
+		i.cur = nil
+		return false
+	}
+	return true
+}
+
+// Next advances the iterator. Returns true if there is a next row.
+func (i *Iter) Next() bool {
+	if i.cur != nil {
+		if i.cur.Next() {
+			return i.clampEnd()
+		}
+		if err := i.cur.Err(); err != nil {
+			i.err = err
+			i.cur = nil
+			return false
+		}
+	}
+	if !i.advanceToNextBlock() {
+		return false
+	}
+	return i.clampEnd()
 }
+
+// Valid returns whether the iterator is positioned at a row.
+func (i *Iter) Valid() bool { return i.cur != nil && i.cur.Valid() }
+
+// Key returns the current row's key.
+func (i *Iter) Key() string { return i.cur.Key() }
+
+// Timestamp returns the current row's timestamp.
+func (i *Iter) Timestamp() int64 { return i.cur.Timestamp() }
+
+// Value returns the current row's value.
+func (i *Iter) Value() []byte { return i.cur.Value() }
+
+// Err returns the first error encountered during iteration, if any.
+func (i *Iter) Err() error { return i.err }
+
+// Close closes the iterator. The underlying Reader is left open and owned by
+// the caller.
+func (i *Iter) Close() error { return nil }
@@ -17,28 +17,123 @@ package sst
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"hash"
 	"hash/crc32"
-	"os"
 
+	"github.com/danchia/ddb/ratelimit"
+	"github.com/danchia/ddb/vfs"
 	"github.com/golang/glog"
 )
 
 type Writer struct {
-	f   *os.File
+	f   vfs.File
 	w   *bufio.Writer
 	crc hash.Hash32
 
-	lastKey string
-	offset  uint64
+	opts WriterOptions
+
+	firstKey string
+	lastKey  string
+	offset   uint64
 
 	dataBlockB  *dataBlockBuilder
 	indexBlockB *indexBlockBuilder
 }
 
+// WriterOptions controls how a Writer encodes the SST it produces.
+type WriterOptions struct {
+	// Compression is the codec applied to data and (optionally) index blocks.
+	// Defaults to CompressionNone.
+	Compression CompressionType
+
+	// MinCompressionSizeBytes is the minimum size a block must be before
+	// compression is attempted. Blocks smaller than this, and blocks that
+	// don't compress well, are stored raw.
+	MinCompressionSizeBytes int
+
+	// MinCompressionRatio is how much smaller a compressed block must be,
+	// relative to its raw size, to be worth keeping compressed; e.g. 0.9
+	// means it must compress to at most 90% of its raw size. Blocks that
+	// don't clear this bar are stored raw instead, since decompressing them
+	// on every future read wouldn't pay for itself. Defaults to 0.9.
+	MinCompressionRatio float64
+
+	// CompressIndexBlock controls whether the index block is subject to
+	// Compression. Index blocks are usually small and keys are rarely
+	// compressible, so this defaults to false.
+	CompressIndexBlock bool
+
+	// FS is the filesystem the SST is written to. Defaults to vfs.Default
+	// (local disk) if nil.
+	FS vfs.FS
+
+	// Limiter throttles the rate, in bytes/sec, at which block data is
+	// written to FS. Used by background jobs (e.g. compaction) that produce
+	// large SSTs and shouldn't saturate disk/network bandwidth needed for
+	// foreground reads and writes. Defaults to ratelimit.Nop() (unlimited) if
+	// nil.
+	Limiter ratelimit.Limiter
+
+	// Checksum is the codec used to verify block integrity. Defaults to
+	// ChecksumCRC32. ChecksumXXHash64 is cheaper to compute and recommended
+	// when Find CPU overhead on cache misses matters; ChecksumBLAKE2b256 is
+	// for deployments that want cryptographic integrity guarantees.
+	Checksum ChecksumType
+
+	// TargetFPRate is the bloom filter false-positive rate, for the number of
+	// keys actually seen (see bloomSize). Defaults to defaultTargetFPRate
+	// (1%). Writer does not build a filter block, so this value does not
+	// change the SST it writes.
+	TargetFPRate float64
+
+	// RestartInterval is how many prefix-compressed keys a data block emits
+	// between restart points (a full key plus its block offset, letting Find
+	// binary search before linear-scanning shared prefixes forward from
+	// there). Defaults to defaultRestartInterval (16). Lower values shrink
+	// the forward scan Find does after its binary search, at the cost of
+	// more full keys (and restart array entries) per block.
+	RestartInterval int32
+}
+
+// DefaultWriterOptions returns the WriterOptions used by NewWriter.
+func DefaultWriterOptions() WriterOptions {
+	return WriterOptions{
+		Compression:             CompressionNone,
+		MinCompressionSizeBytes: 256,
+		MinCompressionRatio:     defaultMinCompressionRatio,
+		FS:                      vfs.Default,
+		Limiter:                 ratelimit.Nop(),
+		Checksum:                ChecksumCRC32,
+		TargetFPRate:            defaultTargetFPRate,
+		RestartInterval:         defaultRestartInterval,
+	}
+}
+
+// NewWriter returns a Writer using DefaultWriterOptions.
 func NewWriter(filename string) (*Writer, error) {
-	f, err := os.Create(filename)
+	return NewWriterOptions(filename, DefaultWriterOptions())
+}
+
+// NewWriterOptions returns a Writer that encodes blocks according to opts.
+func NewWriterOptions(filename string, opts WriterOptions) (*Writer, error) {
+	if opts.FS == nil {
+		opts.FS = vfs.Default
+	}
+	if opts.Limiter == nil {
+		opts.Limiter = ratelimit.Nop()
+	}
+	if opts.MinCompressionRatio == 0 {
+		opts.MinCompressionRatio = defaultMinCompressionRatio
+	}
+	if opts.TargetFPRate == 0 {
+		opts.TargetFPRate = defaultTargetFPRate
+	}
+	if opts.RestartInterval == 0 {
+		opts.RestartInterval = defaultRestartInterval
+	}
+	f, err := opts.FS.Create(filename)
 	if err != nil {
 		return nil, err
 	}
@@ -47,7 +142,8 @@ func NewWriter(filename string) (*Writer, error) {
 		f:           f,
 		w:           bufio.NewWriter(f),
 		crc:         crc32.New(crcTable),
-		dataBlockB:  newDataBlockBuilder(),
+		opts:        opts,
+		dataBlockB:  newDataBlockBuilder(opts.RestartInterval),
 		indexBlockB: newIndexBlockBuilder(),
 	}
 	return w, nil
@@ -61,22 +157,44 @@ func (s *Writer) Append(key string, timestamp int64, value []byte) error {
 			return err
 		}
 	}
+	if s.firstKey == "" {
+		s.firstKey = key
+	}
 	s.lastKey = key
 	return s.dataBlockB.Append(key, timestamp, value)
 }
 
+// FirstKey returns the smallest key Append'd so far, or "" if Append hasn't
+// been called yet.
+func (s *Writer) FirstKey() string {
+	return s.firstKey
+}
+
+// SizeBytes returns the number of bytes written so far plus the estimated
+// size of the still-buffered data block; the index block and footer that
+// Close writes are not counted. Used by callers (e.g. compaction) that want
+// to cap individual output files at a target size.
+func (s *Writer) SizeBytes() int64 {
+	return int64(s.offset) + s.dataBlockB.EstimatedSizeBytes()
+}
+
+// LastKey returns the largest key Append'd so far, or "" if Append hasn't
+// been called yet.
+func (s *Writer) LastKey() string {
+	return s.lastKey
+}
+
 func (s *Writer) flushBlock() error {
 	blockData, err := s.dataBlockB.Finish()
 	if err != nil {
 		return err
 	}
 
-	bh := blockHandle{s.offset, uint64(len(blockData))}
-	s.indexBlockB.Append(s.lastKey, bh)
-
-	if err := s.writeChecksummedBlock(blockData); err != nil {
+	bh, err := s.writeChecksummedBlock(blockData, s.opts.Compression)
+	if err != nil {
 		return err
 	}
+	s.indexBlockB.Append(s.lastKey, bh)
 
 	s.dataBlockB.Reset()
 	return nil
@@ -106,27 +224,44 @@ func (s *Writer) writeIndexBlock() (blockHandle, error) {
 	if err != nil {
 		return blockHandle{}, err
 	}
-	bh := blockHandle{s.offset, uint64(len(d))}
-	return bh, s.writeChecksummedBlock(d)
+	compression := CompressionNone
+	if s.opts.CompressIndexBlock {
+		compression = s.opts.Compression
+	}
+	return s.writeChecksummedBlock(d, compression)
 }
 
-func (s *Writer) writeChecksummedBlock(d []byte) error {
-	if _, err := s.w.Write(d); err != nil {
-		return err
+// writeChecksummedBlock compresses d (if requested and worthwhile), writes it
+// followed by a trailer of [compression type byte][checksum type byte][checksum
+// of payload+both type bytes], and returns a blockHandle describing where the
+// payload was written.
+func (s *Writer) writeChecksummedBlock(d []byte, compression CompressionType) (blockHandle, error) {
+	payload, ct := compressBlock(d, compression, s.opts.MinCompressionSizeBytes, s.opts.MinCompressionRatio)
+
+	bh := blockHandle{s.offset, uint64(len(payload))}
+
+	trailerSize := blockTrailerSize(s.opts.Checksum)
+	if err := s.opts.Limiter.WaitN(context.Background(), int64(len(payload)+trailerSize)); err != nil {
+		return bh, err
 	}
 
-	s.crc.Reset()
-	if _, err := s.crc.Write(d); err != nil {
-		// Technically should not be possible
-		return err
+	if _, err := s.w.Write(payload); err != nil {
+		return bh, err
 	}
-	c := s.crc.Sum32()
-	if err := writeUint32(s.w, c); err != nil {
-		return err
+	typeBytes := []byte{byte(ct), byte(s.opts.Checksum)}
+	if _, err := s.w.Write(typeBytes); err != nil {
+		return bh, err
 	}
-	s.offset += uint64(len(d)) + 4
 
-	return nil
+	h := newHasher(s.opts.Checksum)
+	h.Write(payload)
+	h.Write(typeBytes)
+	if _, err := s.w.Write(h.Sum(nil)); err != nil {
+		return bh, err
+	}
+	s.offset += uint64(len(payload) + trailerSize)
+
+	return bh, nil
 }
 
 func (s *Writer) writeFooter(indexHandle blockHandle) error {
@@ -145,8 +280,13 @@ func (s *Writer) writeFooter(indexHandle blockHandle) error {
 		return err
 	}
 
+	// Trailing byte identifying the block checksum codec used throughout this
+	// file. Readers that don't find it (files written before ChecksumType
+	// existed) fall back to assuming ChecksumCRC32; see Reader.readFooter.
+	footer.WriteByte(byte(s.opts.Checksum))
+
 	d := footer.Bytes()
-	if len(d) != footerSize {
+	if len(d) != footerSize+1 {
 		glog.Fatalf("writerFooter generated footer of wrong length: %v", d)
 	}
 
@@ -0,0 +1,417 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package orderedcode provides a binary encoding of a sequence of values
+// that preserves the natural sort order of the sequence: the encoding of
+// vals0 is less than the encoding of vals1 if and only if vals0 is less
+// than vals1, lexicographically.
+package orderedcode
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+const (
+	increasing = 0x00
+	decreasing = 0xff
+)
+
+var errCorrupt = errors.New("orderedcode: corrupt input")
+
+// Infinity is a value greater than all other values, including other
+// infinities.
+var Infinity struct{}
+
+// TrailingString is like a string, except that it is encoded as itself,
+// with no escaping or terminator. It is only valid as the last value
+// passed to Append or Parse.
+type TrailingString string
+
+// StringOrInfinity decodes a value that was encoded either as a string or
+// as Infinity. Exactly one of String and Infinity is meaningful: if the
+// encoded value was Infinity, Infinity is true and String is "".
+type StringOrInfinity struct {
+	String   string
+	Infinity bool
+}
+
+// decr wraps a value (for Append) or a pointer (for Parse) so that it is
+// encoded or decoded in decreasing order.
+type decr struct {
+	x interface{}
+}
+
+// Decr returns a wrapper around x such that, when passed to Append or
+// Parse, x is encoded or decoded in decreasing order instead of the
+// default increasing order.
+func Decr(x interface{}) interface{} {
+	return decr{x}
+}
+
+// Append appends the encoding of vals to dst and returns the extended
+// buffer.
+func Append(dst []byte, vals ...interface{}) ([]byte, error) {
+	for _, val := range vals {
+		var err error
+		dst, err = appendOne(dst, val)
+		if err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+func appendOne(dst []byte, val interface{}) ([]byte, error) {
+	if d, ok := val.(decr); ok {
+		start := len(dst)
+		dst, err := appendIncreasing(dst, d.x)
+		if err != nil {
+			return dst, err
+		}
+		invert(dst[start:])
+		return dst, nil
+	}
+	return appendIncreasing(dst, val)
+}
+
+func appendIncreasing(dst []byte, val interface{}) ([]byte, error) {
+	switch v := val.(type) {
+	case string:
+		return appendString(dst, v), nil
+	case TrailingString:
+		return append(dst, v...), nil
+	case struct{}:
+		return append(dst, 0xff, 0xff), nil
+	case float64:
+		return appendFloat64(dst, v), nil
+	case int64:
+		return appendInt64(dst, v), nil
+	case uint64:
+		return appendUint64(dst, v), nil
+	default:
+		return dst, fmt.Errorf("orderedcode: unsupported type %T", val)
+	}
+}
+
+func appendString(dst []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case 0x00:
+			dst = append(dst, 0x00, 0xff)
+		case 0xff:
+			dst = append(dst, 0xff, 0x00)
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return append(dst, 0x00, 0x01)
+}
+
+func appendUint64(dst []byte, v uint64) []byte {
+	n := byteLen(v)
+	dst = append(dst, byte(n))
+	for i := n - 1; i >= 0; i-- {
+		dst = append(dst, byte(v>>uint(8*i)))
+	}
+	return dst
+}
+
+func byteLen(v uint64) int {
+	n := 0
+	for v != 0 {
+		n++
+		v >>= 8
+	}
+	return n
+}
+
+func appendInt64(dst []byte, v int64) []byte {
+	if v < 0 {
+		return appendSignedMagnitude(dst, true, negate(v))
+	}
+	return appendSignedMagnitude(dst, false, uint64(v))
+}
+
+// negate returns the magnitude of v (which must be negative) as a uint64,
+// without overflowing for v == math.MinInt64.
+func negate(v int64) uint64 {
+	return uint64(-(v + 1)) + 1
+}
+
+func appendFloat64(dst []byte, v float64) []byte {
+	bits := math.Float64bits(v)
+	negative := bits>>63 == 1
+	magnitude := bits &^ (uint64(1) << 63)
+	return appendSignedMagnitude(dst, negative, magnitude)
+}
+
+// appendSignedMagnitude appends a variable-length, order-preserving
+// encoding of a signed number with the given magnitude. The encoding
+// consists of a unary length marker (a run of n one-bits terminated by a
+// zero-bit for non-negative numbers, or a run of n zero-bits terminated
+// by a one-bit for negative numbers) followed by 7n-1 value bits, for the
+// smallest n for which the magnitude fits.
+func appendSignedMagnitude(dst []byte, negative bool, m uint64) []byte {
+	mBig := new(big.Int).SetUint64(m)
+	n := 1
+	for {
+		bits := uint(7*n - 1)
+		limit := new(big.Int).Lsh(big.NewInt(1), bits)
+		if !negative {
+			limit.Sub(limit, big.NewInt(1))
+		}
+		if mBig.Cmp(limit) <= 0 {
+			break
+		}
+		n++
+	}
+	bits := uint(7*n - 1)
+
+	value := new(big.Int)
+	marker := new(big.Int)
+	if negative {
+		value.Lsh(big.NewInt(1), bits)
+		value.Sub(value, mBig)
+		marker.SetInt64(1)
+	} else {
+		value.Set(mBig)
+		marker.Lsh(big.NewInt(1), uint(n))
+		marker.Sub(marker, big.NewInt(1))
+		marker.Lsh(marker, 1)
+	}
+
+	tv := marker.Lsh(marker, bits)
+	tv.Add(tv, value)
+
+	buf := make([]byte, n)
+	tv.FillBytes(buf)
+	return append(dst, buf...)
+}
+
+func invert(b []byte) {
+	for i, c := range b {
+		b[i] = ^c
+	}
+}
+
+// Parse parses the encoding in src, storing the decoded values in vals,
+// and returns any unparsed suffix of src.
+func Parse(src string, vals ...interface{}) (string, error) {
+	for _, val := range vals {
+		var err error
+		src, err = parseOne(src, val)
+		if err != nil {
+			return src, err
+		}
+	}
+	return src, nil
+}
+
+func parseOne(src string, val interface{}) (string, error) {
+	if d, ok := val.(decr); ok {
+		inv := []byte(src)
+		invert(inv)
+		rest, err := parseIncreasing(string(inv), d.x)
+		if err != nil {
+			return src, err
+		}
+		consumed := len(src) - len(rest)
+		return src[consumed:], nil
+	}
+	return parseIncreasing(src, val)
+}
+
+func parseIncreasing(src string, val interface{}) (string, error) {
+	switch v := val.(type) {
+	case *string:
+		s, rest, err := parseString(src)
+		if err != nil {
+			return src, err
+		}
+		*v = s
+		return rest, nil
+	case *TrailingString:
+		*v = TrailingString(src)
+		return "", nil
+	case *struct{}:
+		if len(src) < 2 || src[0] != 0xff || src[1] != 0xff {
+			return src, errCorrupt
+		}
+		return src[2:], nil
+	case *float64:
+		f, rest, err := parseFloat64(src)
+		if err != nil {
+			return src, err
+		}
+		*v = f
+		return rest, nil
+	case *int64:
+		i, rest, err := parseInt64(src)
+		if err != nil {
+			return src, err
+		}
+		*v = i
+		return rest, nil
+	case *uint64:
+		u, rest, err := parseUint64(src)
+		if err != nil {
+			return src, err
+		}
+		*v = u
+		return rest, nil
+	case *StringOrInfinity:
+		if len(src) >= 2 && src[0] == 0xff && src[1] == 0xff {
+			*v = StringOrInfinity{Infinity: true}
+			return src[2:], nil
+		}
+		s, rest, err := parseString(src)
+		if err != nil {
+			return src, err
+		}
+		*v = StringOrInfinity{String: s}
+		return rest, nil
+	default:
+		return src, fmt.Errorf("orderedcode: unsupported type %T", val)
+	}
+}
+
+func parseString(src string) (string, string, error) {
+	var b []byte
+	i := 0
+	for {
+		if i >= len(src) {
+			return "", src, errCorrupt
+		}
+		switch c := src[i]; c {
+		case 0x00:
+			if i+1 >= len(src) {
+				return "", src, errCorrupt
+			}
+			switch src[i+1] {
+			case 0xff:
+				b = append(b, 0x00)
+				i += 2
+			case 0x01:
+				return string(b), src[i+2:], nil
+			default:
+				return "", src, errCorrupt
+			}
+		case 0xff:
+			if i+1 >= len(src) || src[i+1] != 0x00 {
+				return "", src, errCorrupt
+			}
+			b = append(b, 0xff)
+			i += 2
+		default:
+			b = append(b, c)
+			i++
+		}
+	}
+}
+
+func parseUint64(src string) (uint64, string, error) {
+	if len(src) == 0 {
+		return 0, src, errCorrupt
+	}
+	n := int(src[0])
+	if n > 8 || len(src) < 1+n {
+		return 0, src, errCorrupt
+	}
+	var v uint64
+	for i := 0; i < n; i++ {
+		v = v<<8 | uint64(src[1+i])
+	}
+	if n > 0 && src[1] == 0 {
+		return 0, src, errCorrupt
+	}
+	return v, src[1+n:], nil
+}
+
+func parseInt64(src string) (int64, string, error) {
+	negative, m, rest, err := parseSignedMagnitude(src)
+	if err != nil {
+		return 0, src, err
+	}
+	if negative {
+		if m == 0 || m-1 > math.MaxInt64 {
+			return 0, src, errCorrupt
+		}
+		return -int64(m-1) - 1, rest, nil
+	}
+	if m > math.MaxInt64 {
+		return 0, src, errCorrupt
+	}
+	return int64(m), rest, nil
+}
+
+func parseFloat64(src string) (float64, string, error) {
+	negative, m, rest, err := parseSignedMagnitude(src)
+	if err != nil {
+		return 0, src, err
+	}
+	if m >= uint64(1)<<63 {
+		return 0, src, errCorrupt
+	}
+	bits := m
+	if negative {
+		bits |= uint64(1) << 63
+	}
+	return math.Float64frombits(bits), rest, nil
+}
+
+// parseSignedMagnitude is the inverse of appendSignedMagnitude.
+func parseSignedMagnitude(src string) (negative bool, m uint64, rest string, err error) {
+	if len(src) == 0 {
+		return false, 0, src, errCorrupt
+	}
+	firstBit := src[0] >> 7 & 1
+	negative = firstBit == 0
+
+	n, bitPos := 0, 0
+	for {
+		byteIdx := bitPos / 8
+		if byteIdx >= len(src) {
+			return false, 0, src, errCorrupt
+		}
+		bit := (src[byteIdx] >> uint(7-bitPos%8)) & 1
+		bitPos++
+		if bit != firstBit {
+			break
+		}
+		n++
+	}
+	if len(src) < n {
+		return false, 0, src, errCorrupt
+	}
+
+	bits := uint(7*n - 1)
+	tv := new(big.Int).SetBytes([]byte(src[:n]))
+	mask := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), bits), big.NewInt(1))
+	value := new(big.Int).And(tv, mask)
+
+	var mBig big.Int
+	if negative {
+		mBig.Lsh(big.NewInt(1), bits)
+		mBig.Sub(&mBig, value)
+	} else {
+		mBig.Set(value)
+	}
+	if !mBig.IsUint64() {
+		return false, 0, src, errCorrupt
+	}
+	return negative, mBig.Uint64(), src[n:], nil
+}
@@ -0,0 +1,165 @@
+package vfs
+
+import (
+	"io"
+	"path"
+
+	"github.com/golang/glog"
+)
+
+// NewCachingFS wraps remote, an FS whose reads are assumed to be slow and/or
+// expensive (e.g. an object-storage backed FS such as S3 or GCS), with a
+// local on-disk cache. Files are pulled from remote into localDir in full on
+// first Open and served locally thereafter, which is a good fit for SSTables
+// where the hot parts (footer, index, filter block) get re-read often once a
+// file is resident. Writes always go straight to remote, then populate the
+// local cache so a freshly flushed/compacted SST is immediately servable
+// from disk.
+func NewCachingFS(remote FS, local FS, localDir string) FS {
+	return &cachingFS{remote: remote, local: local, localDir: localDir}
+}
+
+type cachingFS struct {
+	remote   FS
+	local    FS
+	localDir string
+}
+
+func (c *cachingFS) cachePath(name string) string {
+	return path.Join(c.localDir, path.Base(name))
+}
+
+func (c *cachingFS) Open(name string) (File, error) {
+	cp := c.cachePath(name)
+
+	if f, err := c.local.Open(cp); err == nil {
+		return f, nil
+	}
+
+	if err := c.local.MkdirAll(c.localDir); err != nil {
+		return nil, err
+	}
+	if err := copyFile(c.remote, name, c.local, cp); err != nil {
+		return nil, err
+	}
+	glog.V(2).Infof("vfs: cached %v locally at %v", name, cp)
+	return c.local.Open(cp)
+}
+
+func (c *cachingFS) Create(name string) (File, error) {
+	rf, err := c.remote.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &cachingWriteFile{remote: rf, local: c.local, localPath: c.cachePath(name)}, nil
+}
+
+func (c *cachingFS) Remove(name string) error {
+	// Best-effort local cache eviction; remote is the source of truth.
+	_ = c.local.Remove(c.cachePath(name))
+	return c.remote.Remove(name)
+}
+
+func (c *cachingFS) Truncate(name string, size int64) error {
+	// Best-effort local cache eviction, same as Remove: remote is the source
+	// of truth and will be re-pulled into the cache on next Open.
+	_ = c.local.Remove(c.cachePath(name))
+	return c.remote.Truncate(name, size)
+}
+
+func (c *cachingFS) Rename(oldname, newname string) error {
+	_ = c.local.Remove(c.cachePath(oldname))
+	return c.remote.Rename(oldname, newname)
+}
+
+func (c *cachingFS) List(dir string) ([]string, error) {
+	return c.remote.List(dir)
+}
+
+func (c *cachingFS) MkdirAll(dir string) error {
+	return c.remote.MkdirAll(dir)
+}
+
+func copyFile(srcFS FS, srcName string, dstFS FS, dstName string) error {
+	src, err := srcFS.Open(srcName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	size, err := src.Size()
+	if err != nil {
+		return err
+	}
+
+	dst, err := dstFS.Create(dstName)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, size)
+	if _, err := src.ReadAt(buf, 0); err != nil && err != io.EOF {
+		dst.Close()
+		return err
+	}
+	if _, err := dst.Write(buf); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// cachingWriteFile mirrors every write to both the remote FS (source of
+// truth) and the local cache, so a file that was just written is already
+// warm for subsequent reads without a round trip to remote.
+type cachingWriteFile struct {
+	remote File
+	local  FS
+
+	localPath string
+	localFile File
+}
+
+func (f *cachingWriteFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.remote.ReadAt(p, off)
+}
+
+func (f *cachingWriteFile) Write(p []byte) (int, error) {
+	if f.localFile == nil {
+		lf, err := f.local.Create(f.localPath)
+		if err != nil {
+			return 0, err
+		}
+		f.localFile = lf
+	}
+	if _, err := f.localFile.Write(p); err != nil {
+		return 0, err
+	}
+	return f.remote.Write(p)
+}
+
+func (f *cachingWriteFile) Close() error {
+	if f.localFile != nil {
+		if err := f.localFile.Close(); err != nil {
+			return err
+		}
+	}
+	return f.remote.Close()
+}
+
+func (f *cachingWriteFile) Sync() error {
+	if f.localFile != nil {
+		if err := f.localFile.Sync(); err != nil {
+			return err
+		}
+	}
+	return f.remote.Sync()
+}
+
+func (f *cachingWriteFile) Size() (int64, error) {
+	return f.remote.Size()
+}
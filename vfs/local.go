@@ -0,0 +1,81 @@
+package vfs
+
+import (
+	"os"
+)
+
+// localFS implements FS on top of the local disk, preserving the behaviour
+// DDB had before FS was introduced.
+type localFS struct{}
+
+func (localFS) Open(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &localFile{f}, nil
+}
+
+func (localFS) Create(name string) (File, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &localFile{f}, nil
+}
+
+func (localFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (localFS) Truncate(name string, size int64) error {
+	return os.Truncate(name, size)
+}
+
+func (localFS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (localFS) List(dir string) ([]string, error) {
+	fis, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	return names, nil
+}
+
+func (localFS) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, 0777)
+}
+
+type localFile struct {
+	f *os.File
+}
+
+func (l *localFile) ReadAt(p []byte, off int64) (int, error) {
+	return l.f.ReadAt(p, off)
+}
+
+func (l *localFile) Write(p []byte) (int, error) {
+	return l.f.Write(p)
+}
+
+func (l *localFile) Close() error {
+	return l.f.Close()
+}
+
+func (l *localFile) Sync() error {
+	return l.f.Sync()
+}
+
+func (l *localFile) Size() (int64, error) {
+	fi, err := l.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
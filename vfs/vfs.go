@@ -0,0 +1,69 @@
+// Package vfs abstracts the filesystem operations used to read and write
+// SSTables and WAL segments, so that DDB can be pointed at something other
+// than local disk (e.g. object storage) and so tests can run against an
+// in-memory filesystem instead of tmpdirs.
+package vfs
+
+import (
+	"io"
+	"os"
+)
+
+// File is a file handle returned by an FS. SSTables need random access reads
+// via ReadAt; the WAL and SST writers only ever append sequentially via
+// Write, but both are modelled on the same interface for simplicity.
+type File interface {
+	io.ReaderAt
+	io.Writer
+	io.Closer
+
+	// Sync flushes the file's contents to stable storage.
+	Sync() error
+
+	// Size returns the current size of the file.
+	Size() (int64, error)
+}
+
+// FS is a filesystem abstraction. Implementations must be safe for
+// concurrent use.
+type FS interface {
+	// Open opens name for reading.
+	Open(name string) (File, error)
+
+	// Create creates name for writing, truncating it if it already exists.
+	Create(name string) (File, error)
+
+	// Remove removes name.
+	Remove(name string) error
+
+	// Truncate truncates name to size bytes, discarding anything beyond it.
+	// Used by wal.Reader.Repair to drop a torn tail record after a crash.
+	Truncate(name string, size int64) error
+
+	// Rename renames oldname to newname, replacing newname if it exists.
+	Rename(oldname, newname string) error
+
+	// List returns the base names of the entries in dir.
+	List(dir string) ([]string, error)
+
+	// MkdirAll creates dir, and any parents necessary, if they don't already exist.
+	MkdirAll(dir string) error
+}
+
+// Default is the FS used throughout DDB unless an alternative is configured.
+var Default FS = localFS{}
+
+// notExister is implemented by errors that can report whether they represent
+// a missing file, analogous to os.IsNotExist.
+type notExister interface {
+	notExist() bool
+}
+
+// IsNotExist reports whether err indicates that a file does not exist,
+// across both the local and in-memory FS implementations.
+func IsNotExist(err error) bool {
+	if ne, ok := err.(notExister); ok {
+		return ne.notExist()
+	}
+	return os.IsNotExist(err)
+}
@@ -1,15 +1,27 @@
 package wal
 
 import (
-	"os"
-	"path/filepath"
+	"context"
+	"path"
 
+	"github.com/danchia/ddb/ratelimit"
+	"github.com/danchia/ddb/vfs"
 	"github.com/golang/glog"
 )
 
-// CleanUnusedFiles cleans unused log files, i.e those that have already been applied.
+// CleanUnusedFiles cleans unused log files on the local filesystem, i.e.
+// those that have already been applied. Use CleanUnusedFilesFS to operate
+// on an alternative vfs.FS or to throttle deletions with a ratelimit.Limiter.
 func CleanUnusedFiles(dirname string, appliedUntil int64) {
-	parsedNames, err := listLogFiles(dirname)
+	CleanUnusedFilesFS(dirname, appliedUntil, vfs.Default, ratelimit.Nop())
+}
+
+// CleanUnusedFilesFS is like CleanUnusedFiles but operates on fs, and paces
+// deletions through limiter (one unit per file removed) so a large backlog
+// of stale logs doesn't burst a flood of filesystem operations. Pass
+// ratelimit.Nop() for unlimited.
+func CleanUnusedFilesFS(dirname string, appliedUntil int64, fs vfs.FS, limiter ratelimit.Limiter) {
+	parsedNames, err := listLogFiles(dirname, fs)
 	if err != nil {
 		glog.Warningf("error listing log files: %v", err)
 		return
@@ -20,10 +32,16 @@ func CleanUnusedFiles(dirname string, appliedUntil int64) {
 		if pn.seqNo < appliedUntil && i > 0 {
 			// can delete *previous* logfile, which spans
 			// [parsedNames[i-1].seqNo, parsedNames[i].seqNo)
-			fullFn := filepath.Join(dirname, parsedNames[i-1].name)
+			fullFn := path.Join(dirname, parsedNames[i-1].name)
+
+			if err := limiter.WaitN(context.Background(), 1); err != nil {
+				glog.Warningf("cleanup cancelled while waiting to remove %v: %v", fullFn, err)
+				return
+			}
+
 			glog.V(2).Infof("deleting unused log file %v", fullFn)
 
-			if err := os.Remove(fullFn); err != nil {
+			if err := fs.Remove(fullFn); err != nil {
 				glog.Warningf("error while removing unused logfile %v: %v", fullFn, err)
 			} else {
 				cleaned++
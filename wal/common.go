@@ -2,10 +2,10 @@ package wal
 
 import (
 	"fmt"
-	"io/ioutil"
 	"sort"
 	"strings"
 
+	"github.com/danchia/ddb/vfs"
 	"github.com/golang/glog"
 )
 
@@ -14,14 +14,13 @@ type filenameInfo struct {
 	seqNo int64
 }
 
-func listLogFiles(dirname string) ([]filenameInfo, error) {
-	fis, err := ioutil.ReadDir(dirname)
+func listLogFiles(dirname string, fs vfs.FS) ([]filenameInfo, error) {
+	names, err := fs.List(dirname)
 	if err != nil {
 		return nil, err
 	}
-	parsedNames := make([]filenameInfo, 0, len(fis))
-	for _, fi := range fis {
-		name := fi.Name()
+	parsedNames := make([]filenameInfo, 0, len(names))
+	for _, name := range names {
 		if !(strings.HasPrefix(name, "wal-") && strings.HasSuffix(name, ".log")) {
 			glog.Warningf("Skipping file %v in WAL directory, does not appear to be a WAL file.", name)
 			continue
@@ -0,0 +1,77 @@
+package wal
+
+import (
+	"path"
+
+	pb "github.com/danchia/ddb/proto"
+	"github.com/danchia/ddb/vfs"
+	"github.com/golang/glog"
+)
+
+// Reader replays log records from a write ahead log directory in sequence
+// order, verifying each record's CRC, and knows how to repair a torn tail
+// record left behind by a crash mid-Append.
+type Reader struct {
+	dirname string
+	fs      vfs.FS
+	sc      *Scanner
+}
+
+// NewReader returns a Reader over all the log files found in dirname on the
+// local filesystem. Use NewReaderFS to read from an alternative vfs.FS.
+func NewReader(dirname string) (*Reader, error) {
+	return NewReaderFS(dirname, vfs.Default)
+}
+
+// NewReaderFS is like NewReader but operates on fs. Returns fs.List's error
+// if dirname can't be listed; a directory with no log files gives a Reader
+// that replays nothing.
+func NewReaderFS(dirname string, fs vfs.FS) (*Reader, error) {
+	sc, err := NewScannerFS(dirname, fs)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{dirname: dirname, fs: fs, sc: sc}, nil
+}
+
+// ReplayFrom calls fn, in sequence order, for every log record with
+// Sequence > seq, so the server can rebuild its memtable from the log on
+// startup. If the scan stops on a torn tail record in the last log file —
+// the expected shape of a crash that happened mid-Append — ReplayFrom
+// returns nil rather than an error; call Repair afterwards to truncate the
+// file and drop the torn record. Any other error, including corruption in a
+// file that isn't the last one, is returned as-is.
+func (r *Reader) ReplayFrom(seq int64, fn func(*pb.LogRecord) error) error {
+	for r.sc.Scan() {
+		l := r.sc.Record()
+		if l.Sequence <= seq {
+			continue
+		}
+		if err := fn(l); err != nil {
+			return err
+		}
+	}
+
+	if err := r.sc.Err(); err != nil {
+		if _, _, ok := r.sc.TornTail(); ok {
+			glog.Warningf("wal: stopped at a torn tail record, will repair on Repair(): %v", err)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// Repair truncates the log file to the end of the last valid record,
+// discarding a torn tail record left behind by a crash. It's a no-op
+// unless the preceding ReplayFrom/Scan stopped at a torn tail.
+func (r *Reader) Repair() error {
+	fn, offset, ok := r.sc.TornTail()
+	if !ok {
+		return nil
+	}
+
+	full := path.Join(r.dirname, fn)
+	glog.Infof("wal: repairing %v, truncating to %v bytes", full, offset)
+	return r.fs.Truncate(full, offset)
+}
@@ -20,10 +20,10 @@ import (
 	"hash"
 	"hash/crc32"
 	"io"
-	"os"
-	"path/filepath"
+	"path"
 
 	pb "github.com/danchia/ddb/proto"
+	"github.com/danchia/ddb/vfs"
 	"github.com/golang/protobuf/proto"
 )
 
@@ -31,6 +31,7 @@ import (
 // Not thread-safe.
 type Scanner struct {
 	dirname string
+	fs      vfs.FS
 	// list of log files to scan, in ascending seqNo.
 	filenameInfos []filenameInfo
 
@@ -40,15 +41,23 @@ type Scanner struct {
 	err error
 }
 
-// NewScanner returns a log scanner over all the log files found in dirname.
-// Returns ErrNotExist if there are no log files.
+// NewScanner returns a log scanner over all the log files found in dirname
+// on the local filesystem. Use NewScannerFS to read from an alternative
+// vfs.FS.
 func NewScanner(dirname string) (*Scanner, error) {
-	parsedNames, err := listLogFiles(dirname)
+	return NewScannerFS(dirname, vfs.Default)
+}
+
+// NewScannerFS returns a log scanner over all the log files found in dirname
+// on fs. Returns fs.List's error if dirname can't be listed; a directory
+// with no log files gives a Scanner that scans nothing.
+func NewScannerFS(dirname string, fs vfs.FS) (*Scanner, error) {
+	parsedNames, err := listLogFiles(dirname, fs)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Scanner{dirname: dirname, filenameInfos: parsedNames}, nil
+	return &Scanner{dirname: dirname, filenameInfos: parsedNames, fs: fs}, nil
 }
 
 // Scan advances the fileScanner to the next log record, which will then be
@@ -81,7 +90,7 @@ func (s *Scanner) maybeAdvanceFileScanner() bool {
 		fi := s.filenameInfos[s.curIndex]
 		s.curIndex++
 
-		fileScanner, err := newFileScanner(filepath.Join(s.dirname, fi.name))
+		fileScanner, err := newFileScanner(path.Join(s.dirname, fi.name), s.fs)
 		if err != nil {
 			s.err = err
 			return false
@@ -109,17 +118,36 @@ func (s *Scanner) Err() error {
 	return nil
 }
 
+// TornTail reports the file and byte offset to truncate to if the scan
+// stopped because of a torn or corrupt record at the end of the last log
+// file, as opposed to in an earlier one. Only the last file can have a torn
+// tail: earlier files are sealed by rollover once a later file exists, so
+// corruption there is a real integrity problem, not a crash-time partial
+// write, and must not be silently repaired.
+func (s *Scanner) TornTail() (filename string, offset int64, ok bool) {
+	if s.curScanner == nil || s.curScanner.err == nil || s.curIndex != len(s.filenameInfos) {
+		return "", 0, false
+	}
+	return s.filenameInfos[s.curIndex-1].name, s.curScanner.lastGoodOffset, true
+}
+
 // fileScanner reads log records from a write ahead log.
 // Not thread-safe.
 type fileScanner struct {
-	f   *os.File
-	err error
-	l   *pb.LogRecord
-	h   hash.Hash32
+	f      vfs.File
+	offset int64
+	err    error
+	l      *pb.LogRecord
+	h      hash.Hash32
+
+	// lastGoodOffset is the offset immediately after the last record fully
+	// read and verified. If Scan subsequently fails, this is where a torn or
+	// corrupt tail begins, and thus where Repair should truncate to.
+	lastGoodOffset int64
 }
 
-func newFileScanner(name string) (*fileScanner, error) {
-	f, err := os.Open(name)
+func newFileScanner(name string, fs vfs.FS) (*fileScanner, error) {
+	f, err := fs.Open(name)
 	if err != nil {
 		return nil, err
 	}
@@ -131,6 +159,26 @@ func newFileScanner(name string) (*fileScanner, error) {
 	return s, nil
 }
 
+// readFull reads exactly len(p) bytes starting at the scanner's current
+// offset, advancing it by however many bytes were actually read.
+//
+// Unlike a raw ReadAt, a short non-zero read is reported as
+// io.ErrUnexpectedEOF rather than io.EOF, matching io.ReadFull's contract.
+// This matters to callers: io.EOF means "nothing left, a clean stopping
+// point", while ErrUnexpectedEOF means "a record was torn off mid-way" and
+// must not be mistaken for the former.
+func (s *fileScanner) readFull(p []byte) error {
+	n, err := s.f.ReadAt(p, s.offset)
+	s.offset += int64(n)
+	if n == len(p) {
+		return nil
+	}
+	if err == io.EOF && n > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
 // Scan advances the fileScanner to the next log record, which will then be
 // available through the Record method. It returns false when the scan stops,
 // either by reaching the end of the log or on error.
@@ -138,7 +186,7 @@ func (s *fileScanner) Scan() bool {
 	s.l.Reset()
 
 	var scratch [8]byte
-	if _, s.err = io.ReadFull(s.f, scratch[:]); s.err != nil {
+	if s.err = s.readFull(scratch[:]); s.err != nil {
 		if s.err == io.EOF {
 			// Expected error.
 			s.err = nil
@@ -151,7 +199,7 @@ func (s *fileScanner) Scan() bool {
 	// TODO: reuse buffers
 	data := make([]byte, dataLen, dataLen)
 
-	if _, s.err = io.ReadFull(s.f, data); s.err != nil {
+	if s.err = s.readFull(data); s.err != nil {
 		return false
 	}
 	s.h.Reset()
@@ -168,6 +216,7 @@ func (s *fileScanner) Scan() bool {
 		return false
 	}
 
+	s.lastGoodOffset = s.offset
 	return true
 }
 
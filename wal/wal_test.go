@@ -19,6 +19,7 @@ import (
 	"os"
 	"sync"
 	"testing"
+	"time"
 
 	pb "github.com/danchia/ddb/proto"
 	"github.com/golang/protobuf/proto"
@@ -121,6 +122,163 @@ func TestConcWriteCallbackInOrder(t *testing.T) {
 	}
 }
 
+func TestGroupCommitBatchesConcurrentAppends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := Options{
+		Dirname:       dir,
+		TargetSize:    1 << 20,
+		MaxBatchDelay: 50 * time.Millisecond,
+	}
+
+	w, err := NewWriter(1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	const n = 20
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		l := &pb.LogRecord{Mutation: &pb.Mutation{Key: "a"}}
+		go func() {
+			defer wg.Done()
+			if err := appendSync(w, l); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := w.GroupCommitStats()
+	if stats.BatchRecords < 2 {
+		t.Errorf("GroupCommitStats().BatchRecords = %d, want at least 2 records batched into one fsync", stats.BatchRecords)
+	}
+}
+
+func TestAppendRejectedWhenOverloaded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := Options{
+		Dirname:       dir,
+		TargetSize:    1 << 20,
+		MaxBatchDelay: 200 * time.Millisecond,
+		// A record's encoded LogRecord is a handful of bytes; this is small
+		// enough that a couple of concurrent Appends exceed it while the
+		// first batch is still waiting out MaxBatchDelay.
+		MaxInFlightBytes: 8,
+	}
+
+	w, err := NewWriter(1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l := &pb.LogRecord{Mutation: &pb.Mutation{Key: "a"}}
+			w.Append(l, func(err error) { errs[i] = err })
+		}(i)
+	}
+	wg.Wait()
+
+	var overloaded int
+	for _, err := range errs {
+		if err == ErrWALOverloaded {
+			overloaded++
+		}
+	}
+	if overloaded == 0 {
+		t.Error("expected at least one Append to be rejected with ErrWALOverloaded")
+	}
+	if s := w.Stalls(); s != int64(overloaded) {
+		t.Errorf("Stalls() = %d, want %d", s, overloaded)
+	}
+
+	// Once the batch above has synced and released its in-flight bytes, a
+	// fresh Append should succeed again.
+	time.Sleep(opts.MaxBatchDelay + 100*time.Millisecond)
+	if err := appendSync(w, &pb.LogRecord{Mutation: &pb.Mutation{Key: "b"}}); err != nil {
+		t.Errorf("Append after batch drained = %v, want nil", err)
+	}
+}
+
+// TestAppendRejectedWhenOverloadedExcludesMonitor verifies that an Append
+// rejected with ErrWALOverloaded doesn't feed the Writer's throughput
+// Monitor, since that bandwidth was never actually written: counting it
+// would let rejected writes look like real throughput to flowcontrol
+// admission control and the zpages metrics it backs.
+func TestAppendRejectedWhenOverloadedExcludesMonitor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := Options{
+		Dirname:          dir,
+		TargetSize:       1 << 20,
+		MaxBatchDelay:    200 * time.Millisecond,
+		MaxInFlightBytes: 8,
+	}
+
+	w, err := NewWriter(1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l := &pb.LogRecord{Mutation: &pb.Mutation{Key: "a"}}
+			w.Append(l, func(err error) { errs[i] = err })
+		}(i)
+	}
+	wg.Wait()
+
+	var accepted, rejected int
+	for _, err := range errs {
+		if err == ErrWALOverloaded {
+			rejected++
+		} else {
+			accepted++
+		}
+	}
+	if rejected == 0 {
+		t.Fatal("expected at least one Append to be rejected with ErrWALOverloaded")
+	}
+	if accepted == 0 {
+		t.Fatal("expected at least one Append to be accepted")
+	}
+
+	// Every accepted record carries the same Mutation, so they all encode
+	// to the same size; BytesTotal should reflect exactly the accepted
+	// ones, not the rejected ones too.
+	encoded, err := proto.Marshal(&pb.LogRecord{Sequence: 1, Mutation: &pb.Mutation{Key: "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBytes := int64(accepted) * int64(len(encoded))
+	if got := w.Monitor().Status().BytesTotal; got != wantBytes {
+		t.Errorf("Monitor().Status().BytesTotal = %d, want %d (accepted=%d rejected=%d)", got, wantBytes, accepted, rejected)
+	}
+}
+
 func appendSync(w *Writer, l *pb.LogRecord) error {
 	c := make(chan error)
 	w.Append(l, func(err error) {
@@ -17,13 +17,18 @@ package wal
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash"
 	"hash/crc32"
-	"os"
+	"math"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/danchia/ddb/flowcontrol"
 	pb "github.com/danchia/ddb/proto"
+	"github.com/danchia/ddb/vfs"
 	"github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
 )
@@ -31,10 +36,22 @@ import (
 const (
 	// MaxRecordBytes is the largest size a single record can be.
 	MaxRecordBytes uint32 = 100 * 1024 * 1024
+
+	// monitorHalfLife controls how quickly the Writer's throughput Monitor
+	// reacts to bursts in Append traffic.
+	monitorHalfLife = 2 * time.Second
 )
 
 var (
 	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// ErrWALOverloaded is returned by Append, instead of queueing the record,
+	// once Options.MaxInFlightBytes worth of Appended records are still
+	// between Append and their completion callback (queued on recordCh, or
+	// written but not yet fsynced). Callers should map this to a retryable
+	// status (e.g. gRPC codes.ResourceExhausted) so clients back off instead
+	// of piling more work onto an already-saturated fsync loop.
+	ErrWALOverloaded = errors.New("wal: overloaded, in-flight bytes exceeds configured high-watermark")
 )
 
 // Writer writes log entries to the write ahead log.
@@ -48,29 +65,101 @@ type Writer struct {
 	opts     Options
 	mu       sync.Mutex
 
-	f         *os.File
+	f         vfs.File
 	bufWriter *bufio.Writer
 	recordCh  chan rawRecord
 
+	// monitor tracks Append throughput, in bytes of encoded LogRecord per
+	// second, so callers can report it (Stats) or throttle on it.
+	monitor *flowcontrol.Monitor
+
+	// groupCommitStats holds a GroupCommitStats, refreshed by writeLoop after
+	// every batch it fsyncs. An atomic.Value lets GroupCommitStats() read the
+	// latest snapshot without contending with writeLoop's hot path.
+	groupCommitStats atomic.Value
+
+	// inFlightBytes and inFlightRecords count what's currently between
+	// Append and its completion callback, so Append can refuse new records
+	// with ErrWALOverloaded once Options.MaxInFlightBytes is exceeded,
+	// rather than blocking on a full recordCh while holding mu (which would
+	// otherwise stall every other Append too). stalls counts how many
+	// Append calls have been refused this way.
+	inFlightBytes   int64
+	inFlightRecords int64
+	stalls          int64
+
 	closeCh       chan struct{}
 	closeResultCh chan error
 }
 
+// GroupCommitStats is a snapshot of writeLoop's most recently completed
+// batch, so callers on the Set/Write path can surface batching behaviour
+// (e.g. to OpenCensus) without reaching into the write loop themselves.
+type GroupCommitStats struct {
+	// BatchRecords is the number of records the last batch fsynced together.
+	BatchRecords int
+	// BatchBytes is the sum of those records' encoded sizes.
+	BatchBytes int
+	// FsyncLatency is how long the last batch's fsync call took.
+	FsyncLatency time.Duration
+	// QueueDepth is how many records were queued on recordCh, waiting for a
+	// batch to pick them up, immediately after the last batch closed.
+	QueueDepth int
+}
+
 type Options struct {
 	Dirname    string
 	TargetSize int64
+
+	// FS is the filesystem log segments are written to. Defaults to
+	// vfs.Default (local disk) if nil.
+	FS vfs.FS
+
+	// MaxBatchDelay bounds how long writeLoop holds a batch open waiting for
+	// more Append calls to join it before fsyncing, once at least one record
+	// is queued. 0 means don't wait at all: sync as soon as recordCh is
+	// drained, i.e. only Append calls that already raced in get batched
+	// together (the original behaviour).
+	MaxBatchDelay time.Duration
+
+	// MaxBatchBytes closes a batch early, before MaxBatchDelay elapses, once
+	// the sum of its records' encoded sizes reaches this many bytes. 0 means
+	// unlimited.
+	MaxBatchBytes int
+
+	// MaxBatchRecords closes a batch early, before MaxBatchDelay elapses,
+	// once it holds this many records. 0 means unlimited.
+	MaxBatchRecords int
+
+	// MaxInFlightBytes rejects Append calls with ErrWALOverloaded once the
+	// sum of record bytes already Appended but not yet synced and
+	// callback'd reaches this high-watermark, so a backed-up fsync loop
+	// sheds load instead of blocking every caller on a full recordCh. 0
+	// means unlimited.
+	MaxInFlightBytes int64
 }
 
 func NewWriter(nextSeq int64, opts Options) (*Writer, error) {
+	if opts.FS == nil {
+		opts.FS = vfs.Default
+	}
+	if opts.MaxBatchBytes <= 0 {
+		opts.MaxBatchBytes = math.MaxInt32
+	}
+	if opts.MaxBatchRecords <= 0 {
+		opts.MaxBatchRecords = math.MaxInt32
+	}
 	writer := &Writer{
 		buf:           proto.NewBuffer(nil),
 		crc:           crc32.New(crcTable),
 		nextSeq:       nextSeq,
 		opts:          opts,
 		recordCh:      make(chan rawRecord, 1000),
+		monitor:       flowcontrol.NewMonitor(monitorHalfLife),
 		closeCh:       make(chan struct{}),
 		closeResultCh: make(chan error),
 	}
+	writer.groupCommitStats.Store(GroupCommitStats{})
 	if err := writer.rollover(nextSeq); err != nil {
 		return nil, err
 	}
@@ -86,7 +175,9 @@ type rawRecord struct {
 }
 
 // Append appends a log record to the WAL. The log record is modified with the log sequence number.
-// cb is invoked serially, in log sequence number order.
+// cb is invoked serially, in log sequence number order. If in-flight bytes
+// have already reached Options.MaxInFlightBytes, cb is invoked immediately with
+// ErrWALOverloaded instead, and the record is never queued.
 func (w *Writer) Append(l *pb.LogRecord, cb func(error)) {
 	glog.V(2).Infof("wal.Append %v", l)
 
@@ -96,10 +187,51 @@ func (w *Writer) Append(l *pb.LogRecord, cb func(error)) {
 	r, err := w.formRecord(l)
 	if err != nil {
 		cb(err)
+		return
+	}
+
+	if w.opts.MaxInFlightBytes > 0 && atomic.LoadInt64(&w.inFlightBytes) >= w.opts.MaxInFlightBytes {
+		atomic.AddInt64(&w.stalls, 1)
+		cb(ErrWALOverloaded)
+		return
+	}
+
+	r.cb = w.wrapCallback(len(r.data), cb)
+
+	// recordCh is bounded, so a writeLoop that's fallen behind (or a flood
+	// of small records that fills its fixed slot count well before
+	// MaxInFlightBytes' byte-based watermark trips) can fill it. Sending
+	// with a default case instead of blocking keeps that case covered by
+	// the same ErrWALOverloaded shedding, rather than stalling every
+	// Append under w.mu until a slot frees up.
+	select {
+	case w.recordCh <- r:
+	default:
+		atomic.AddInt64(&w.stalls, 1)
+		cb(ErrWALOverloaded)
+		return
 	}
-	r.cb = cb
 
-	w.recordCh <- r
+	// Only a record that actually made it onto recordCh counts as real
+	// throughput: updating the monitor before this point would let rejected
+	// Appends inflate the EMA that flowcontrol.Limiter.Admit and the
+	// zpages throughput metric both read, which would feed back into
+	// admission control rejecting even more writes under sustained overload.
+	w.monitor.Update(len(r.data))
+
+	atomic.AddInt64(&w.inFlightBytes, int64(len(r.data)))
+	atomic.AddInt64(&w.inFlightRecords, 1)
+}
+
+// wrapCallback returns a callback that releases the in-flight accounting
+// Append reserved for this record before invoking cb, so InFlightBytes/
+// InFlightRecords always reflect records between Append and completion.
+func (w *Writer) wrapCallback(dataLen int, cb func(error)) func(error) {
+	return func(err error) {
+		atomic.AddInt64(&w.inFlightBytes, -int64(dataLen))
+		atomic.AddInt64(&w.inFlightRecords, -1)
+		cb(err)
+	}
 }
 
 func (w *Writer) formRecord(l *pb.LogRecord) (rawRecord, error) {
@@ -136,7 +268,7 @@ func (w *Writer) formRecord(l *pb.LogRecord) (rawRecord, error) {
 }
 
 func logName(nextSeq int64, o Options) string {
-	return fmt.Sprintf("%s%cwal-%d.log", o.Dirname, os.PathSeparator, nextSeq)
+	return fmt.Sprintf("%s/wal-%d.log", o.Dirname, nextSeq)
 }
 
 func (w *Writer) rollover(seq int64) error {
@@ -155,7 +287,7 @@ func (w *Writer) rollover(seq int64) error {
 			return err
 		}
 	}
-	f, err := os.Create(fn)
+	f, err := w.opts.FS.Create(fn)
 	if err != nil {
 		return err
 	}
@@ -174,36 +306,55 @@ func (w *Writer) writeLoop() {
 Main:
 	for {
 		callbacks = callbacks[:0]
+		batchBytes := 0
+
 		// wait for first record
 		select {
 		case r := <-w.recordCh:
-			if err := w.writeRawRecord(r); err != nil {
-				r.cb(err)
-			} else {
-				callbacks = append(callbacks, r.cb)
-			}
+			batchBytes += w.applyRawRecord(r, &callbacks)
 		case <-w.closeCh:
 			break Main
 		}
 
-		// write out all remaining records
-	L:
+		// Keep the batch open for up to MaxBatchDelay, hoping more Append
+		// calls join it so the fsync below is amortized over more records,
+		// unless MaxBatchBytes/MaxBatchRecords is hit first.
+		if w.opts.MaxBatchDelay > 0 {
+			deadline := time.NewTimer(w.opts.MaxBatchDelay)
+		Wait:
+			for len(callbacks) < w.opts.MaxBatchRecords && batchBytes < w.opts.MaxBatchBytes {
+				select {
+				case r := <-w.recordCh:
+					batchBytes += w.applyRawRecord(r, &callbacks)
+				case <-deadline.C:
+					break Wait
+				}
+			}
+			deadline.Stop()
+		}
+
+		// Opportunistically pick up anything else already queued, without
+		// waiting for it: this is cheap and shrinks the next batch.
+	Drain:
 		for {
 			select {
 			case r := <-w.recordCh:
-				if err := w.writeRawRecord(r); err != nil {
-					r.cb(err)
-				} else {
-					callbacks = append(callbacks, r.cb)
-				}
+				batchBytes += w.applyRawRecord(r, &callbacks)
 			default:
-				break L
+				break Drain
 			}
 		}
 
 		// sync, then notify.
 		glog.V(4).Infof("Notifying %v callbacks", len(callbacks))
+		fsyncStart := time.Now()
 		err := w.sync()
+		w.groupCommitStats.Store(GroupCommitStats{
+			BatchRecords: len(callbacks),
+			BatchBytes:   batchBytes,
+			FsyncLatency: time.Since(fsyncStart),
+			QueueDepth:   len(w.recordCh),
+		})
 		for _, cb := range callbacks {
 			cb(err)
 		}
@@ -217,6 +368,21 @@ Main:
 	w.closeResultCh <- w.f.Close()
 }
 
+// applyRawRecord writes r to the log buffer, appending r.cb to *callbacks
+// (so writeLoop can notify it once the enclosing batch is synced), and
+// returns the number of record bytes added to the batch so the caller can
+// track MaxBatchBytes. If the write itself fails, r.cb is invoked
+// immediately with the error instead, since that record won't be part of
+// any future sync.
+func (w *Writer) applyRawRecord(r rawRecord, callbacks *[]func(error)) int {
+	if err := w.writeRawRecord(r); err != nil {
+		r.cb(err)
+		return 0
+	}
+	*callbacks = append(*callbacks, r.cb)
+	return len(r.data)
+}
+
 func (w *Writer) writeRawRecord(r rawRecord) error {
 	glog.V(4).Infof("wal writing raw record for seq %v", r.seq)
 
@@ -254,3 +420,42 @@ func (w *Writer) Close() error {
 	w.closeCh <- struct{}{}
 	return <-w.closeResultCh
 }
+
+// Stats returns the Writer's observed Append throughput.
+func (w *Writer) Stats() flowcontrol.Status {
+	return w.monitor.Status()
+}
+
+// Monitor returns the flowcontrol.Monitor backing Stats, so callers (e.g. a
+// flowcontrol.Limiter) can make admission decisions off the same observed
+// throughput without double-counting bytes.
+func (w *Writer) Monitor() *flowcontrol.Monitor {
+	return w.monitor
+}
+
+// GroupCommitStats returns a snapshot of the most recently completed write
+// batch (see Options.MaxBatchDelay), so callers can track batching
+// effectiveness and fsync latency alongside Stats' throughput numbers.
+func (w *Writer) GroupCommitStats() GroupCommitStats {
+	return w.groupCommitStats.Load().(GroupCommitStats)
+}
+
+// InFlightBytes returns the number of record bytes currently between
+// Append and their completion callback (queued on recordCh, or written but
+// not yet fsynced), the same quantity Append compares against
+// Options.MaxInFlightBytes.
+func (w *Writer) InFlightBytes() int64 {
+	return atomic.LoadInt64(&w.inFlightBytes)
+}
+
+// InFlightRecords is like InFlightBytes, but counts records instead of
+// bytes.
+func (w *Writer) InFlightRecords() int64 {
+	return atomic.LoadInt64(&w.inFlightRecords)
+}
+
+// Stalls returns the number of Append calls rejected with ErrWALOverloaded
+// since the Writer was created.
+func (w *Writer) Stalls() int64 {
+	return atomic.LoadInt64(&w.stalls)
+}